@@ -0,0 +1,568 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lucasb-eyer/go-colorful"
+)
+
+// ColorRamp maps raster value (height, slope degrees, etc.) to color
+type ColorRamp interface {
+	ValueToColor(v float64) color.Color
+}
+
+func (gm *gradientMap) ValueToColor(v float64) color.Color {
+	if math.IsNaN(v) {
+		return gm.nodata.NRGBA()
+	}
+	return gm.heightColor(v).NRGBA()
+}
+
+// ColorInterpolation is color space of blending between ramp stops
+type ColorInterpolation string
+
+const (
+	InterpolationRGB ColorInterpolation = "rgb"
+	InterpolationLab ColorInterpolation = "lab"
+	InterpolationHCL ColorInterpolation = "hcl"
+	InterpolationLuv ColorInterpolation = "luv"
+)
+
+func parseColorInterpolation(s string) (ColorInterpolation, error) {
+	switch ci := ColorInterpolation(strings.ToLower(s)); ci {
+	case "":
+		return InterpolationRGB, nil
+	case InterpolationRGB, InterpolationLab, InterpolationHCL, InterpolationLuv:
+		return ci, nil
+	}
+	return "", fmt.Errorf("unsupported color interpolation: %s, expected rgb, lab, hcl or luv", s)
+}
+
+func (ci ColorInterpolation) blend(c1 colorful.Color, c2 colorful.Color, t float64) colorful.Color {
+	switch ci {
+	case InterpolationLab:
+		return c1.BlendLab(c2, t)
+	case InterpolationHCL:
+		return c1.BlendHcl(c2, t)
+	case InterpolationLuv:
+		return c1.BlendLuv(c2, t)
+	}
+	return c1.BlendRgb(c2, t)
+}
+
+// ramp modes, continuous ramp blends colors between stops,
+// discrete ramp uses color of class break at or below value
+const (
+	RampModeContinuous = "continuous"
+	RampModeDiscrete   = "discrete"
+)
+
+func parseRampMode(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "", RampModeContinuous:
+		return false, nil
+	case RampModeDiscrete:
+		return true, nil
+	}
+	return false, fmt.Errorf("unsupported ramp mode: %s, expected continuous or discrete", s)
+}
+
+// rampClass is color of values starting from min up to min of next class
+type rampClass struct {
+	min float64
+	col color.NRGBA
+}
+
+// classRamp maps values into discrete color classes,
+// values below the first class are transparent
+type classRamp struct {
+	classes []rampClass
+}
+
+func (cr *classRamp) ValueToColor(v float64) color.Color {
+	col := color.NRGBA{}
+	for _, c := range cr.classes {
+		if v < c.min {
+			break
+		}
+		col = c.col
+	}
+	return col
+}
+
+// slopeRampPresets are built-in color ramps of slope in degrees
+var slopeRampPresets = map[string]func() (ColorRamp, error){
+	"gradient": func() (ColorRamp, error) {
+		return NewGradientMap([]colorCard{
+			{0, "#ffffff"},
+			{15, "#fee08b"},
+			{30, "#fc8d59"},
+			{45, "#d73027"},
+			{60, "#7f0000"},
+			{90, "#000000"},
+		}, 0.1)
+	},
+	// classic avalanche terrain bands
+	"avalanche": func() (ColorRamp, error) {
+		return &classRamp{classes: []rampClass{
+			{30, color.NRGBA{0xff, 0xee, 0x00, 0xc0}},
+			{35, color.NRGBA{0xff, 0x99, 0x00, 0xc0}},
+			{40, color.NRGBA{0xee, 0x00, 0x00, 0xc0}},
+			{45, color.NRGBA{0x99, 0x00, 0xcc, 0xc0}},
+		}}, nil
+	},
+}
+
+const defaultSlopeRamp = "gradient"
+
+// newSlopeRamps creates slope color ramps of presets and color ramps
+// with stops in degrees, presets are added unless overridden
+func newSlopeRamps(ramps map[string]colorRamp) (map[string]ColorRamp, error) {
+	slopeRamps := make(map[string]ColorRamp, len(slopeRampPresets)+len(ramps))
+	for name, preset := range slopeRampPresets {
+		ramp, err := preset()
+		if err != nil {
+			return nil, fmt.Errorf("slope color ramp %s: %w", name, err)
+		}
+		slopeRamps[name] = ramp
+	}
+
+	for name, ramp := range ramps {
+		if ramp.units == UnitsFeet {
+			return nil, fmt.Errorf("slope color ramp %s: stops are in degrees, units are not supported", name)
+		}
+		gm, err := newRampGradientMap(ramp, 0.1)
+		if err != nil {
+			return nil, fmt.Errorf("slope color ramp %s: %w", name, err)
+		}
+		slopeRamps[name] = gm
+	}
+
+	return slopeRamps, nil
+}
+
+// newTRIRamp creates color ramp of Riley's terrain ruggedness index in meters
+func newTRIRamp() (ColorRamp, error) {
+	return NewGradientMap([]colorCard{
+		{0, "#ffffff"},
+		{15, "#fee391"},
+		{60, "#fe9929"},
+		{150, "#cc4c02"},
+		{450, "#662506"},
+	}, 0.1)
+}
+
+// newTPIRamp creates diverging color ramp of topographic position index
+// in meters, valleys are blue and ridges red
+func newTPIRamp() (ColorRamp, error) {
+	return NewGradientMap([]colorCard{
+		{-50, "#2166ac"},
+		{-10, "#92c5de"},
+		{0, "#f7f7f7"},
+		{10, "#f4a582"},
+		{50, "#b2182b"},
+	}, 0.1)
+}
+
+// newCurvatureRamp creates diverging color ramp of curvature in 1/100 m,
+// concave areas are blue and convex red
+func newCurvatureRamp() (ColorRamp, error) {
+	return NewGradientMap([]colorCard{
+		{-2, "#2166ac"},
+		{-0.5, "#92c5de"},
+		{0, "#f7f7f7"},
+		{0.5, "#f4a582"},
+		{2, "#b2182b"},
+	}, 0.01)
+}
+
+const defaultReliefRamp = "default"
+
+// defaultReliefColorCard is color card of default color-relief ramp
+var defaultReliefColorCard = []colorCard{
+	// < 0  40 120 160 #2878a0
+
+	// 0    110 220 110 #6edc6e
+	// 900  240 250 160 #f0faa0
+	// 1300 230 220 170 #e6dcaa
+	// 1900 220 220 220 #dcdcdc
+	// 2500 250 250 250 #fafafa
+
+	//	   0 102 153 153 #0669999
+	//	   1  46 154  88 #2e9a58
+	//	 600 251 255 128 #fbff80
+	//	1200 224 108  31 #e06c1f
+	//	2500 200  55  55 #c83737
+	//	4000 215 244 244 #d7f4f4
+
+	// #066999 0%, #2E9A58 5%, #FBFF80 18%, #E19545 37%, #DA7029 60%, #D7F4F4
+
+	{0.00, "#066999"},
+	{0.01, "#2E9A58"},
+	{900.0, "#FBFF80"},
+	{1300.0, "#E19545"},
+	{1900.0, "#DA7029"},
+	{2500.0, "#d7f4f4"},
+}
+
+// gdalColorNames are color names supported by gdaldem color-relief
+var gdalColorNames = map[string]string{
+	"white":   "#ffffff",
+	"black":   "#000000",
+	"red":     "#ff0000",
+	"green":   "#00ff00",
+	"blue":    "#0000ff",
+	"yellow":  "#ffff00",
+	"magenta": "#ff00ff",
+	"fuchsia": "#ff00ff",
+	"cyan":    "#00ffff",
+	"aqua":    "#00ffff",
+	"grey":    "#bebebe",
+	"gray":    "#bebebe",
+	"orange":  "#ffa500",
+	"brown":   "#a52a2a",
+	"purple":  "#a020f0",
+	"violet":  "#ee82ee",
+	"indigo":  "#4b0082",
+}
+
+// colorRamp is color card of ramp with its rendering options
+type colorRamp struct {
+	cards         []colorCard
+	interpolation ColorInterpolation
+	discrete      bool
+	// nodata is color hex of NaN values, transparent if empty
+	nodata string
+	// units of stop heights, meters if empty
+	units Units
+}
+
+// colorRampConfig is color ramp file with options overriding the file
+type colorRampConfig struct {
+	file          string
+	interpolation string
+	mode          string
+	nodata        string
+	units         string
+}
+
+// newRampGradientMap creates gradient map of color ramp,
+// stop heights are converted to meters of elevation data
+func newRampGradientMap(ramp colorRamp, heighPrecision float64) (*gradientMap, error) {
+	cards := make([]colorCard, len(ramp.cards))
+	for idx, c := range ramp.cards {
+		cards[idx] = colorCard{ramp.units.ToMeters(c.height), c.colorHex}
+	}
+	gm, err := NewGradientMap(cards, heighPrecision)
+	if err != nil {
+		return nil, err
+	}
+	gm.interpolation = ramp.interpolation
+	if gm.interpolation == "" {
+		gm.interpolation = InterpolationRGB
+	}
+	gm.discrete = ramp.discrete
+	if ramp.nodata != "" {
+		col, alpha, err := ParseHexAlpha(ramp.nodata)
+		if err != nil {
+			return nil, err
+		}
+		gm.nodata = HeightColor{Col: col, Height: math.NaN(), Alpha: alpha}
+	}
+	return gm, nil
+}
+
+// newReliefRamps creates gradient maps of color-relief ramps,
+// default ramp is added unless overridden
+func newReliefRamps(ramps map[string]colorRamp) (map[string]*gradientMap, error) {
+	gms := make(map[string]*gradientMap, len(ramps)+1)
+
+	gm, err := NewGradientMap(defaultReliefColorCard, 0.1)
+	if err != nil {
+		return nil, err
+	}
+	gms[defaultReliefRamp] = gm
+
+	for name, ramp := range ramps {
+		gm, err := newRampGradientMap(ramp, 0.1)
+		if err != nil {
+			return nil, fmt.Errorf("color ramp %s: %w", name, err)
+		}
+		gms[name] = gm
+	}
+
+	return gms, nil
+}
+
+// loadColorRamps reads color ramps from files and applies their options,
+// files with .cpt extension are parsed as cpt-city palettes,
+// others as gdaldem color-relief text files
+func loadColorRamps(configs map[string]colorRampConfig) (map[string]colorRamp, error) {
+	ramps := make(map[string]colorRamp, len(configs))
+	for name, cfg := range configs {
+		f, err := os.Open(cfg.file)
+		if err != nil {
+			return nil, fmt.Errorf("color ramp %s: %w", name, err)
+		}
+
+		var ramp colorRamp
+		if strings.ToLower(filepath.Ext(cfg.file)) == ".cpt" {
+			ramp, err = parseCPTColorRamp(f)
+		} else {
+			ramp, err = parseGDALColorRamp(f)
+		}
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("color ramp %s: %s: %w", name, cfg.file, err)
+		}
+
+		ramp.interpolation, err = parseColorInterpolation(cfg.interpolation)
+		if err != nil {
+			return nil, fmt.Errorf("color ramp %s: %w", name, err)
+		}
+		ramp.discrete, err = parseRampMode(cfg.mode)
+		if err != nil {
+			return nil, fmt.Errorf("color ramp %s: %w", name, err)
+		}
+		ramp.units, err = parseUnits(cfg.units)
+		if err != nil {
+			return nil, fmt.Errorf("color ramp %s: %w", name, err)
+		}
+		if cfg.nodata != "" {
+			ramp.nodata, _, err = parseRampColor(strings.Fields(cfg.nodata))
+			if err != nil {
+				return nil, fmt.Errorf("color ramp %s: nodata: %w", name, err)
+			}
+		}
+
+		ramps[name] = ramp
+	}
+	return ramps, nil
+}
+
+// splitColorRampLine splits line into fields separated by whitespace,
+// commas, colons or slashes, skipping comments
+func splitColorRampLine(line string) []string {
+	if idx := strings.Index(line, "#"); idx == 0 {
+		return nil
+	}
+	return strings.FieldsFunc(line, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ',' || r == ':' || r == '/'
+	})
+}
+
+// parseGDALColorRamp parses gdaldem color-relief color text file:
+// lines of "elevation R G B [A]" or "elevation color_name",
+// nodata color is set by "nv" line. Percentage elevations are not supported.
+func parseGDALColorRamp(r io.Reader) (colorRamp, error) {
+	var ramp colorRamp
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		fields := splitColorRampLine(strings.TrimSpace(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.EqualFold(fields[0], "nv") {
+			nodata, _, err := parseRampColor(fields[1:])
+			if err != nil {
+				return colorRamp{}, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			ramp.nodata = nodata
+			continue
+		}
+		if strings.HasSuffix(fields[0], "%") {
+			return colorRamp{}, fmt.Errorf("line %d: percentage elevation is not supported", lineNum)
+		}
+
+		height, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return colorRamp{}, fmt.Errorf("line %d: invalid elevation: %s", lineNum, fields[0])
+		}
+
+		colorHex, _, err := parseRampColor(fields[1:])
+		if err != nil {
+			return colorRamp{}, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+
+		ramp.cards = append(ramp.cards, colorCard{height, colorHex})
+	}
+	if err := scanner.Err(); err != nil {
+		return colorRamp{}, err
+	}
+
+	var err error
+	ramp.cards, err = sortColorCards(ramp.cards)
+	return ramp, err
+}
+
+// parseCPTColorRamp parses cpt-city (GMT) palette of segments
+// "z0 color0 z1 color1", colors are R G B, R/G/B, H-S-V or names.
+// NaN color (N line) is nodata color, background and foreground
+// colors (B, F lines) are skipped.
+func parseCPTColorRamp(r io.Reader) (colorRamp, error) {
+	var ramp colorRamp
+	var cards []colorCard
+	hsv := false
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			if strings.Contains(strings.ToUpper(line), "COLOR_MODEL") {
+				hsv = strings.Contains(strings.ToUpper(line), "HSV")
+			}
+			continue
+		}
+
+		fields := splitColorRampLine(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if hsv {
+			// H-S-V triplets use dashes, leading dash is sign of z-value
+			var hsvFields []string
+			for _, f := range fields {
+				if len(f) > 1 && strings.Contains(f[1:], "-") {
+					hsvFields = append(hsvFields, strings.Split(f, "-")...)
+				} else {
+					hsvFields = append(hsvFields, f)
+				}
+			}
+			fields = hsvFields
+		}
+
+		switch fields[0] {
+		case "B", "F":
+			continue
+		case "N":
+			nodata, _, err := parseCPTColor(fields[1:], hsv)
+			if err != nil {
+				return colorRamp{}, fmt.Errorf("line %d: %w", lineNum, err)
+			}
+			ramp.nodata = nodata
+			continue
+		}
+
+		z0, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return colorRamp{}, fmt.Errorf("line %d: invalid z-value: %s", lineNum, fields[0])
+		}
+		col0, n, err := parseCPTColor(fields[1:], hsv)
+		if err != nil {
+			return colorRamp{}, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+
+		rest := fields[1+n:]
+		if len(rest) == 0 {
+			return colorRamp{}, fmt.Errorf("line %d: missing segment end", lineNum)
+		}
+		z1, err := strconv.ParseFloat(rest[0], 64)
+		if err != nil {
+			return colorRamp{}, fmt.Errorf("line %d: invalid z-value: %s", lineNum, rest[0])
+		}
+		col1, _, err := parseCPTColor(rest[1:], hsv)
+		if err != nil {
+			return colorRamp{}, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+
+		// segments share boundary, skip repeated stop of continuous palette
+		if len(cards) == 0 || cards[len(cards)-1] != (colorCard{z0, col0}) {
+			cards = append(cards, colorCard{z0, col0})
+		}
+		cards = append(cards, colorCard{z1, col1})
+	}
+	if err := scanner.Err(); err != nil {
+		return colorRamp{}, err
+	}
+
+	var err error
+	ramp.cards, err = sortColorCards(cards)
+	return ramp, err
+}
+
+func parseCPTColor(fields []string, hsv bool) (string, int, error) {
+	if !hsv {
+		// cpt colors have no alpha, next field is z-value
+		if len(fields) > 3 {
+			fields = fields[:3]
+		}
+		return parseRampColor(fields)
+	}
+	if len(fields) < 3 {
+		return "", 0, fmt.Errorf("invalid HSV color: %v", fields)
+	}
+	var v [3]float64
+	for i := range v {
+		f, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid HSV color: %v", fields[:3])
+		}
+		v[i] = f
+	}
+	return colorful.Hsv(v[0], v[1], v[2]).Clamped().Hex(), 3, nil
+}
+
+// parseRampColor parses color as R G B [A] components, #rrggbb[aa] hex
+// or color name, returns color hex and number of fields used
+func parseRampColor(fields []string) (string, int, error) {
+	if len(fields) == 0 {
+		return "", 0, fmt.Errorf("missing color")
+	}
+
+	if colorHex, ok := gdalColorNames[strings.ToLower(fields[0])]; ok {
+		return colorHex, 1, nil
+	}
+	if strings.HasPrefix(fields[0], "#") {
+		col, alpha, err := ParseHexAlpha(fields[0])
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid color: %s", fields[0])
+		}
+		return HeightColor{Col: col, Alpha: alpha}.Hex(), 1, nil
+	}
+
+	if len(fields) < 3 {
+		return "", 0, fmt.Errorf("invalid color: %v", fields)
+	}
+	n := 3
+	if len(fields) > 3 {
+		n = 4
+	}
+	var rgba [4]uint8
+	rgba[3] = 0xff
+	for i := 0; i < n; i++ {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil || v < 0 || v > 255 {
+			return "", 0, fmt.Errorf("invalid color component: %s", fields[i])
+		}
+		rgba[i] = uint8(math.Round(v))
+	}
+
+	if rgba[3] == 0xff {
+		return fmt.Sprintf("#%02x%02x%02x", rgba[0], rgba[1], rgba[2]), n, nil
+	}
+	return fmt.Sprintf("#%02x%02x%02x%02x", rgba[0], rgba[1], rgba[2], rgba[3]), n, nil
+}
+
+func sortColorCards(cards []colorCard) ([]colorCard, error) {
+	if len(cards) == 0 {
+		return nil, fmt.Errorf("empty color ramp")
+	}
+	sort.SliceStable(cards, func(i, j int) bool {
+		return cards[i].height < cards[j].height
+	})
+	return cards, nil
+}
@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"encoding/json"
+	"image/color"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseGDALColorRamp_1(t *testing.T) {
+	txt := `# gdaldem color-relief
+3500 white
+2500,235,220,175
+500: 190 185 135 255
+0	110 220 110
+nv 0 0 0 0
+-100 blue
+`
+	ramp, err := parseGDALColorRamp(strings.NewReader(txt))
+	require.NoError(t, err)
+	assert.Equal(t, []colorCard{
+		{-100, "#0000ff"},
+		{0, "#6edc6e"},
+		{500, "#beb987"},
+		{2500, "#ebdcaf"},
+		{3500, "#ffffff"},
+	}, ramp.cards)
+	assert.Equal(t, "#00000000", ramp.nodata)
+
+	for _, txt := range []string{"", "50% 0 0 0", "100 12 34", "high 0 0 0", "100 unknown", "100 300 0 0"} {
+		_, err := parseGDALColorRamp(strings.NewReader(txt))
+		assert.Error(t, err, txt)
+	}
+}
+
+func Test_parseCPTColorRamp_1(t *testing.T) {
+	cpt := `# cpt-city palette
+-500 0 0 255 0 255 255 255
+0 0/128/0 1000 255/255/0
+1000 255 0 0 2000 128 0 0
+B 0 0 0
+F 255 255 255
+N 128 128 128
+`
+	ramp, err := parseCPTColorRamp(strings.NewReader(cpt))
+	require.NoError(t, err)
+	assert.Equal(t, "#808080", ramp.nodata)
+	cards := ramp.cards
+	assert.Equal(t, []colorCard{
+		{-500, "#0000ff"},
+		{0, "#ffffff"},
+		{0, "#008000"},
+		{1000, "#ffff00"},
+		{1000, "#ff0000"},
+		{2000, "#800000"},
+	}, cards)
+
+	// hard breaks do not produce NaN colors
+	gm, err := NewGradientMap(cards, 0.1)
+	require.NoError(t, err)
+	for _, h := range []float64{-500, -250, 0, 500, 1000, 1500, 2000} {
+		col := gm.HeightToColor(h)
+		require.False(t, math.IsNaN(col.R) || math.IsNaN(col.G) || math.IsNaN(col.B), "height %v", h)
+	}
+	assert.Equal(t, "#80c000", gm.HeightToColor(500).Hex())
+
+	hsvCpt := `# COLOR_MODEL = HSV
+-100 240-1-1 100 0-1-1
+`
+	ramp, err = parseCPTColorRamp(strings.NewReader(hsvCpt))
+	require.NoError(t, err)
+	assert.Equal(t, []colorCard{{-100, "#0000ff"}, {100, "#ff0000"}}, ramp.cards)
+
+	for _, cpt := range []string{"", "0 0 0 0", "0 0 0 0 x 0 0 0"} {
+		_, err := parseCPTColorRamp(strings.NewReader(cpt))
+		assert.Error(t, err, cpt)
+	}
+}
+
+func Test_colorReliefHandler_ramps(t *testing.T) {
+	dir := t.TempDir()
+	gdalFile := filepath.Join(dir, "mono.txt")
+	require.NoError(t, os.WriteFile(gdalFile, []byte("0 black\n5000 white\n"), 0644))
+	cptFile := filepath.Join(dir, "red.cpt")
+	require.NoError(t, os.WriteFile(cptFile, []byte("0 255 0 0 5000 255 0 0\n"), 0644))
+
+	ramps, err := loadColorRamps(map[string]colorRampConfig{
+		"mono": {file: gdalFile},
+		"red":  {file: cptFile},
+	})
+	require.NoError(t, err)
+
+	h := newTestTerra(t)
+	h.reliefRamps, err = newReliefRamps(ramps)
+	require.NoError(t, err)
+	r := newRouter(h)
+
+	bodies := make(map[string]string)
+	for _, query := range []string{"", "?ramp=default", "?ramp=mono", "?ramp=red"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/color-relief/14/11583/6049.img"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		bodies[query] = rec.Body.String()
+	}
+	assert.Equal(t, bodies[""], bodies["?ramp=default"])
+	assert.NotEqual(t, bodies[""], bodies["?ramp=mono"])
+	assert.NotEqual(t, bodies["?ramp=mono"], bodies["?ramp=red"])
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/color-relief/14/11583/6049.img?ramp=unknown", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ramps", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var infos []rampInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+	require.Len(t, infos, 3)
+	assert.Equal(t, "default", infos[0].Name)
+	assert.True(t, infos[0].Default)
+	assert.Equal(t, rampInfo{
+		Name:          "mono",
+		Interpolation: InterpolationRGB,
+		Mode:          RampModeContinuous,
+		Units:         UnitsMeters,
+		Stops:         []rampStop{{0, "#000000"}, {5000, "#ffffff"}},
+	}, infos[1])
+
+	_, err = loadColorRamps(map[string]colorRampConfig{"missing": {file: filepath.Join(dir, "missing.txt")}})
+	assert.Error(t, err)
+	ramps, err = loadColorRamps(map[string]colorRampConfig{
+		"mono": {file: gdalFile, interpolation: "LAB", mode: "discrete", nodata: "#ff000080"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, colorRamp{
+		cards:         []colorCard{{0, "#000000"}, {5000, "#ffffff"}},
+		interpolation: InterpolationLab,
+		discrete:      true,
+		nodata:        "#ff000080",
+		units:         UnitsMeters,
+	}, ramps["mono"])
+
+	_, err = loadColorRamps(map[string]colorRampConfig{"mono": {file: gdalFile, interpolation: "cmyk"}})
+	assert.Error(t, err)
+	_, err = loadColorRamps(map[string]colorRampConfig{"mono": {file: gdalFile, mode: "stepped"}})
+	assert.Error(t, err)
+	_, err = loadColorRamps(map[string]colorRampConfig{"mono": {file: gdalFile, units: "yd"}})
+	assert.Error(t, err)
+}
+
+func Test_colorReliefHandler_units(t *testing.T) {
+	dir := t.TempDir()
+	mFile := filepath.Join(dir, "mono_m.txt")
+	require.NoError(t, os.WriteFile(mFile, []byte("0 black\n1524 white\n"), 0644))
+	ftFile := filepath.Join(dir, "mono_ft.txt")
+	require.NoError(t, os.WriteFile(ftFile, []byte("0 black\n5000 white\n"), 0644))
+
+	ramps, err := loadColorRamps(map[string]colorRampConfig{
+		"mono_m":  {file: mFile},
+		"mono_ft": {file: ftFile, units: "ft"},
+	})
+	require.NoError(t, err)
+
+	h := newTestTerra(t)
+	h.reliefRamps, err = newReliefRamps(ramps)
+	require.NoError(t, err)
+	r := newRouter(h)
+
+	// stops in feet are converted to meters of elevation data
+	bodies := make(map[string]string)
+	for _, query := range []string{"?ramp=mono_m", "?ramp=mono_ft", "?ramp=mono_ft&units=ft"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/color-relief/14/11583/6049.img"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		bodies[query] = rec.Body.String()
+	}
+	assert.Equal(t, bodies["?ramp=mono_m"], bodies["?ramp=mono_ft"])
+	assert.Equal(t, bodies["?ramp=mono_ft"], bodies["?ramp=mono_ft&units=ft"])
+
+	getStops := func(query string) map[string][]rampStop {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ramps"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		var infos []rampInfo
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &infos))
+		stops := make(map[string][]rampStop)
+		for _, info := range infos {
+			stops[info.Name] = info.Stops
+		}
+		return stops
+	}
+
+	stops := getStops("")
+	assert.InDelta(t, 1524, stops["mono_ft"][1].Value, 1e-9)
+	stops = getStops("?units=ft")
+	assert.InDelta(t, 5000, stops["mono_ft"][1].Value, 1e-9)
+	assert.InDelta(t, 5000, stops["mono_m"][1].Value, 1e-9)
+
+	// server units are default of requests
+	h.units = UnitsFeet
+	stops = getStops("")
+	assert.InDelta(t, 5000, stops["mono_m"][1].Value, 1e-9)
+	stops = getStops("?units=m")
+	assert.InDelta(t, 1524, stops["mono_m"][1].Value, 1e-9)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ramps?units=yd", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func Test_gradientMap_firstSegment(t *testing.T) {
+	gm, err := NewGradientMap([]colorCard{{0, "#000000"}, {10, "#ffffff"}, {20, "#ff0000"}}, 0.1)
+	require.NoError(t, err)
+
+	// colors between the first two stops are blended
+	col := gm.HeightToColor(5)
+	assert.InDelta(t, 0.5, col.R, 0.01)
+	assert.InDelta(t, 0.5, col.G, 0.01)
+	assert.InDelta(t, 0.5, col.B, 0.01)
+}
+
+func Test_gradientMap_rampOptions(t *testing.T) {
+	cards := []colorCard{
+		{0, "#ff000000"},
+		{100, "#0000ff"},
+		{200, "#00ff00"},
+	}
+
+	gm, err := newRampGradientMap(colorRamp{cards: cards}, 0.1)
+	require.NoError(t, err)
+	// alpha is blended with color
+	assert.Equal(t, color.NRGBA{0x80, 0x00, 0x80, 0x80}, gm.ValueToColor(50))
+	// nodata is transparent by default
+	assert.Equal(t, color.NRGBA{}, gm.ValueToColor(math.NaN()))
+
+	// blend in other color spaces differs from RGB in the middle only
+	rgb := gm.ValueToColor(150)
+	for _, ci := range []ColorInterpolation{InterpolationLab, InterpolationHCL, InterpolationLuv} {
+		gm, err := newRampGradientMap(colorRamp{cards: cards, interpolation: ci}, 0.1)
+		require.NoError(t, err)
+		assert.NotEqual(t, rgb, gm.ValueToColor(150), ci)
+		assert.Equal(t, color.NRGBA{0x00, 0x00, 0xff, 0xff}, gm.ValueToColor(100), ci)
+		assert.Equal(t, color.NRGBA{0x00, 0xff, 0x00, 0xff}, gm.ValueToColor(200), ci)
+	}
+
+	gm, err = newRampGradientMap(colorRamp{cards: cards, discrete: true, nodata: "#808080"}, 0.1)
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBA{0xff, 0x00, 0x00, 0x00}, gm.ValueToColor(-10))
+	assert.Equal(t, color.NRGBA{0xff, 0x00, 0x00, 0x00}, gm.ValueToColor(99.99))
+	assert.Equal(t, color.NRGBA{0x00, 0x00, 0xff, 0xff}, gm.ValueToColor(100))
+	assert.Equal(t, color.NRGBA{0x00, 0x00, 0xff, 0xff}, gm.ValueToColor(199.99))
+	assert.Equal(t, color.NRGBA{0x00, 0xff, 0x00, 0xff}, gm.ValueToColor(200))
+	assert.Equal(t, color.NRGBA{0x80, 0x80, 0x80, 0xff}, gm.ValueToColor(math.NaN()))
+
+	colorHex, n, err := parseRampColor([]string{"10", "20", "30", "128"})
+	require.NoError(t, err)
+	assert.Equal(t, "#0a141e80", colorHex)
+	assert.Equal(t, 4, n)
+}
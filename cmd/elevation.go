@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+const (
+	ElevationEncodingTerrarium  = "terrarium"
+	ElevationEncodingTerrainRGB = "terrain-rgb"
+	ElevationEncodingGray16     = "gray16"
+)
+
+// ElevationDecoder converts elevation tile image into row-major grid
+// of heights in meters
+type ElevationDecoder interface {
+	DecodeElevation(img image.Image) ([]float64, error)
+}
+
+// ElevationEncoder converts row-major grid of heights in meters
+// into elevation tile image
+type ElevationEncoder interface {
+	EncodeElevation(data []float64, width int, height int) (image.Image, error)
+}
+
+func NewElevationDecoder(encoding string) (ElevationDecoder, error) {
+	switch encoding {
+	case ElevationEncodingTerrarium:
+		return terrariumEncoding{}, nil
+	case ElevationEncodingTerrainRGB:
+		return terrainRGBEncoding{}, nil
+	case ElevationEncodingGray16:
+		return gray16Encoding{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported elevation encoding: %s", encoding)
+	}
+}
+
+func NewElevationEncoder(encoding string) (ElevationEncoder, error) {
+	switch encoding {
+	case ElevationEncodingTerrarium:
+		return terrariumEncoding{}, nil
+	case ElevationEncodingTerrainRGB:
+		return terrainRGBEncoding{}, nil
+	case ElevationEncodingGray16:
+		return gray16Encoding{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported elevation encoding: %s", encoding)
+	}
+}
+
+// terrariumEncoding decodes and encodes Mapzen terrarium tiles
+type terrariumEncoding struct{}
+
+func (terrariumEncoding) DecodeElevation(img image.Image) ([]float64, error) {
+	return decodeRGBElevation(img, rgbaToHeight), nil
+}
+
+func (terrariumEncoding) EncodeElevation(data []float64, width int, height int) (image.Image, error) {
+	return encodeRGBElevation(data, width, height, heightToRgba)
+}
+
+// terrainRGBEncoding decodes and encodes Mapbox Terrain-RGB tiles
+type terrainRGBEncoding struct{}
+
+func (terrainRGBEncoding) DecodeElevation(img image.Image) ([]float64, error) {
+	return decodeRGBElevation(img, terrainRGBToHeight), nil
+}
+
+func (terrainRGBEncoding) EncodeElevation(data []float64, width int, height int) (image.Image, error) {
+	return encodeRGBElevation(data, width, height, heightToTerrainRGB)
+}
+
+// gray16Encoding decodes and encodes 16-bit grayscale tiles with heights in whole meters
+type gray16Encoding struct{}
+
+func (gray16Encoding) EncodeElevation(data []float64, width int, height int) (image.Image, error) {
+	if len(data) != width*height {
+		return nil, fmt.Errorf("elevation data size %d does not match %dx%d", len(data), width, height)
+	}
+
+	img := image.NewGray16(image.Rect(0, 0, width, height))
+	for idx, h := range data {
+		v := math.Round(math.Max(0, math.Min(h, math.MaxUint16)))
+		img.Pix[idx*2] = uint8(uint16(v) >> 8)
+		img.Pix[idx*2+1] = uint8(uint16(v))
+	}
+
+	return img, nil
+}
+
+func (gray16Encoding) DecodeElevation(img image.Image) ([]float64, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	data := make([]float64, width*height)
+
+	gray, ok := img.(*image.Gray16)
+	if !ok {
+		gray = image.NewGray16(bounds)
+		draw.Draw(gray, bounds, img, bounds.Min, draw.Src)
+	}
+
+	idx := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			data[idx] = float64(gray.Gray16At(x, y).Y)
+			idx++
+		}
+	}
+
+	return data, nil
+}
+
+func decodeRGBElevation(img image.Image, toHeight func(r uint32, g uint32, b uint32, a uint32) float64) []float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	rgba, ok := img.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) || rgba.Stride != 4*width {
+		rgba = image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	}
+
+	data := make([]float64, width*height)
+
+	for idx := range data {
+		pix := rgba.Pix[idx*4 : idx*4+4]
+		data[idx] = toHeight(uint32(pix[0]), uint32(pix[1]), uint32(pix[2]), uint32(pix[3]))
+	}
+
+	return data
+}
+
+func encodeRGBElevation(data []float64,
+	width int,
+	height int,
+	toRgba func(h float64) (uint8, uint8, uint8)) (image.Image, error) {
+
+	if len(data) != width*height {
+		return nil, fmt.Errorf("elevation data size %d does not match %dx%d", len(data), width, height)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for idx, h := range data {
+		pix := img.Pix[idx*4 : idx*4+4]
+		pix[0], pix[1], pix[2] = toRgba(h)
+		pix[3] = 0xff
+	}
+
+	return img, nil
+}
+
+func rgbaToHeight(r uint32, g uint32, b uint32, a uint32) float64 {
+
+	r &= 0xff
+	g &= 0xff
+	b &= 0xff
+
+	// (red * 256 + green + blue / 256) - 32768
+	h := float64(r*256 + g)
+	h += float64(b) / 256
+	h -= 32768
+	return h
+}
+
+func terrainRGBToHeight(r uint32, g uint32, b uint32, a uint32) float64 {
+
+	r &= 0xff
+	g &= 0xff
+	b &= 0xff
+
+	// -10000 + ((R * 256 * 256 + G * 256 + B) * 0.1)
+	h := float64(r*65536 + g*256 + b)
+	h = h*0.1 - 10000
+	return h
+}
+
+func heightToRgba(h float64) (uint8, uint8, uint8) {
+
+	// v = h + 32768
+	// red = floor(v / 256), green = floor(v) mod 256, blue = frac(v) * 256
+	v := math.Max(0, math.Min(h+32768, 65536-1.0/256))
+	v = math.Round(v*256) / 256
+
+	iv := uint32(v)
+	r := uint8(iv >> 8)
+	g := uint8(iv)
+	b := uint8((v - float64(iv)) * 256)
+	return r, g, b
+}
+
+func heightToTerrainRGB(h float64) (uint8, uint8, uint8) {
+
+	// v = (h + 10000) * 10
+	// red = v / (256 * 256), green = v / 256 mod 256, blue = v mod 256
+	v := math.Round((h + 10000) * 10)
+	v = math.Max(0, math.Min(v, 1<<24-1))
+
+	iv := uint32(v)
+	r := uint8(iv >> 16)
+	g := uint8(iv >> 8)
+	b := uint8(iv)
+	return r, g, b
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_elevationDecoder_1(t *testing.T) {
+	dat, err := os.ReadFile("./test_data/terrarium_14_11583_6049.png")
+	require.NoError(t, err)
+
+	img, _, err := image.Decode(bytes.NewReader(dat))
+	require.NoError(t, err)
+
+	dec, err := NewElevationDecoder(ElevationEncodingTerrarium)
+	require.NoError(t, err)
+
+	data, err := dec.DecodeElevation(img)
+	require.NoError(t, err)
+	require.Equal(t, TileSize*TileSize, len(data))
+
+	r, g, b, _ := img.At(10, 20).RGBA()
+	assert.Equal(t, rgbaToHeight(r>>8, g>>8, b>>8, 0xff), data[20*TileSize+10])
+
+	_, err = NewElevationDecoder("unknown")
+	assert.Error(t, err)
+}
+
+func Test_elevationDecoder_terrainRGB(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	// 0m and 1234.5m
+	img.Set(0, 0, color.NRGBA{0x01, 0x86, 0xa0, 0xff})
+	img.Set(1, 0, color.NRGBA{0x01, 0xb6, 0xd9, 0xff})
+
+	dec, err := NewElevationDecoder(ElevationEncodingTerrainRGB)
+	require.NoError(t, err)
+
+	data, err := dec.DecodeElevation(img)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.0, data[0], epsilon)
+	assert.InDelta(t, 1234.5, data[1], epsilon)
+}
+
+func Test_elevationDecoder_gray16(t *testing.T) {
+	img := image.NewGray16(image.Rect(0, 0, 2, 1))
+	img.SetGray16(0, 0, color.Gray16{Y: 0})
+	img.SetGray16(1, 0, color.Gray16{Y: 2228})
+
+	// decode as PNG to check 16-bit samples are preserved
+	buf := new(bytes.Buffer)
+	require.NoError(t, png.Encode(buf, img))
+	pngImg, err := png.Decode(buf)
+	require.NoError(t, err)
+
+	dec, err := NewElevationDecoder(ElevationEncodingGray16)
+	require.NoError(t, err)
+
+	data, err := dec.DecodeElevation(pngImg)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0, 2228}, data)
+}
+
+func Test_elevationEncoder_roundtrip(t *testing.T) {
+	dat, err := os.ReadFile("./test_data/terrarium_14_11583_6049.png")
+	require.NoError(t, err)
+
+	img, _, err := image.Decode(bytes.NewReader(dat))
+	require.NoError(t, err)
+
+	data, err := terrariumEncoding{}.DecodeElevation(img)
+	require.NoError(t, err)
+
+	testData := []struct {
+		encoding  string
+		precision float64
+	}{
+		{ElevationEncodingTerrarium, 0},
+		{ElevationEncodingTerrainRGB, 0.05},
+		{ElevationEncodingGray16, 0.5},
+	}
+
+	for _, tst := range testData {
+		enc, err := NewElevationEncoder(tst.encoding)
+		require.NoError(t, err)
+		dec, err := NewElevationDecoder(tst.encoding)
+		require.NoError(t, err)
+
+		encImg, err := enc.EncodeElevation(data, TileSize, TileSize)
+		require.NoError(t, err)
+
+		buf := new(bytes.Buffer)
+		require.NoError(t, png.Encode(buf, encImg))
+		pngImg, err := png.Decode(buf)
+		require.NoError(t, err)
+
+		out, err := dec.DecodeElevation(pngImg)
+		require.NoError(t, err)
+		require.Equal(t, len(data), len(out))
+
+		for idx := range data {
+			require.InDelta(t, data[idx], out[idx], tst.precision+epsilon, "%s: pixel %d", tst.encoding, idx)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Copyright © 2022 Val Gridnev
+*/
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/maptile"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Render layer tiles into archive file",
+	Long:  `Render hillshade, color relief or contour tiles for area into MBTiles or PMTiles archive file`,
+	Run:   exportCmdRun,
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().String("layer", "terrain", "layer to render (terrain, color-relief, shaded-relief, contours, isobands, terrain-rgb, slope, aspect, tri, tpi, curvature-profile, curvature-plan)")
+	exportCmd.Flags().Int("min-zoom", 10, "min zoom level")
+	exportCmd.Flags().Int("max-zoom", 12, "max zoom level")
+	exportCmd.Flags().String("bbox", "", "area to render: min_lon,min_lat,max_lon,max_lat")
+	exportCmd.Flags().String("query", "", "layer request query string, e.g. interval=50")
+	exportCmd.Flags().String("out", "", "output file (.mbtiles, .pmtiles)")
+	addTileSourceFlags(exportCmd)
+}
+
+// vectorLayer describes MVT layer and its feature properties
+// in vector_layers of archive metadata
+type vectorLayer struct {
+	ID     string            `json:"id"`
+	Fields map[string]string `json:"fields"`
+}
+
+type exportLayer struct {
+	route  string
+	format string
+	// vectorLayers returns MVT layers of pbf tiles of layer request query
+	vectorLayers func(query url.Values) []vectorLayer
+}
+
+// contourVectorLayers are contour layers, index contours are in separate
+// layer if split query parameter is set
+func contourVectorLayers(query url.Values) []vectorLayer {
+	fields := map[string]string{"elevation": "Number", "index": "Boolean"}
+	layers := []vectorLayer{{"contours", fields}}
+	if query.Get("split") == "1" {
+		layers = append(layers, vectorLayer{"contours_index", fields})
+	}
+	return layers
+}
+
+func isobandVectorLayers(query url.Values) []vectorLayer {
+	return []vectorLayer{
+		{"isobands", map[string]string{"min_elevation": "Number", "max_elevation": "Number"}},
+	}
+}
+
+var exportLayers = map[string]exportLayer{
+	"terrain":           {route: "/terrain/%d/%d/%d.img", format: "png"},
+	"color-relief":      {route: "/color-relief/%d/%d/%d.img", format: "png"},
+	"shaded-relief":     {route: "/shaded-relief/%d/%d/%d.img", format: "png"},
+	"contours":          {route: "/contours/%d/%d/%d.mvt", format: "pbf", vectorLayers: contourVectorLayers},
+	"isobands":          {route: "/isobands/%d/%d/%d.mvt", format: "pbf", vectorLayers: isobandVectorLayers},
+	"terrain-rgb":       {route: "/terrain-rgb/%d/%d/%d.png", format: "png"},
+	"slope":             {route: "/slope/%d/%d/%d.png", format: "png"},
+	"aspect":            {route: "/aspect/%d/%d/%d.png", format: "png"},
+	"tri":               {route: "/tri/%d/%d/%d.png", format: "png"},
+	"tpi":               {route: "/tpi/%d/%d/%d.png", format: "png"},
+	"curvature-profile": {route: "/curvature/profile/%d/%d/%d.png", format: "png"},
+	"curvature-plan":    {route: "/curvature/plan/%d/%d/%d.png", format: "png"},
+}
+
+// vectorLayersMetadata returns json metadata value listing vector layers
+func vectorLayersMetadata(layers []vectorLayer) (string, error) {
+	out, err := json.Marshal(struct {
+		VectorLayers []vectorLayer `json:"vector_layers"`
+	}{layers})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func exportCmdRun(cmd *cobra.Command, args []string) {
+
+	layerName, err := cmd.Flags().GetString("layer")
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+	layer, ok := exportLayers[layerName]
+	if !ok {
+		log.Fatalf("ERR: unsupported layer: %s", layerName)
+	}
+
+	minZoom, err := cmd.Flags().GetInt("min-zoom")
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+	maxZoom, err := cmd.Flags().GetInt("max-zoom")
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+	if minZoom < 0 || maxZoom < minZoom {
+		log.Fatalf("ERR: invalid zoom range: %d-%d", minZoom, maxZoom)
+	}
+
+	bboxStr, err := cmd.Flags().GetString("bbox")
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+	bound, err := parseBBox(bboxStr)
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+
+	query, err := cmd.Flags().GetString("query")
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+
+	outFile, err := cmd.Flags().GetString("out")
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+	if outFile == "" {
+		log.Fatalf("ERR: must provide output file")
+	}
+
+	ctx := context.Background()
+	t, err := newSourceTerra(ctx, cmd)
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+
+	tw, err := newTileWriter(outFile)
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+
+	dt1 := time.Now()
+
+	metadata := map[string]string{
+		"name":    layerName,
+		"type":    "overlay",
+		"format":  layer.format,
+		"minzoom": strconv.Itoa(minZoom),
+		"maxzoom": strconv.Itoa(maxZoom),
+		"bounds":  fmt.Sprintf("%f,%f,%f,%f", bound.Min.Lon(), bound.Min.Lat(), bound.Max.Lon(), bound.Max.Lat()),
+	}
+	if layer.vectorLayers != nil {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			log.Fatalf("ERR: invalid query: %v", err)
+		}
+		metadata["json"], err = vectorLayersMetadata(layer.vectorLayers(values))
+		if err != nil {
+			log.Fatalf("ERR: %v", err)
+		}
+	}
+	for name, value := range metadata {
+		if err := tw.SetMetadata(ctx, name, value); err != nil {
+			log.Fatalf("ERR: %v", err)
+		}
+	}
+
+	cnt, err := exportTiles(ctx, newRouter(t), tw, layer, query, minZoom, maxZoom, bound)
+	if err != nil {
+		tw.Close()
+		log.Fatalf("ERR: %v", err)
+	}
+
+	err = tw.Close()
+	if err != nil {
+		log.Fatalf("ERR: %v", err)
+	}
+
+	err = t.Close()
+	if err != nil {
+		log.Printf("ERR: %v", err)
+	}
+
+	dt2 := time.Now()
+	log.Printf("Exported %d tiles into %s in %v", cnt, outFile, dt2.Sub(dt1))
+}
+
+func newTileWriter(fileName string) (TileWriter, error) {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".mbtiles":
+		return CreateMBTilesTileStore(fileName)
+	case ".pmtiles":
+		return CreatePMTilesTileWriter(fileName)
+	default:
+		return nil, fmt.Errorf("unsupported output file type: %s", fileName)
+	}
+}
+
+// exportTiles renders layer tiles covering bound through the server handler
+// and writes them into tile writer, returns number of written tiles
+func exportTiles(ctx context.Context,
+	handler http.Handler,
+	tw TileWriter,
+	layer exportLayer,
+	query string,
+	minZoom int,
+	maxZoom int,
+	bound orb.Bound) (int, error) {
+
+	cnt := 0
+	for zoom := minZoom; zoom <= maxZoom; zoom++ {
+		z := maptile.Zoom(zoom)
+		tMin := maptile.At(orb.Point{bound.Min.Lon(), bound.Max.Lat()}, z)
+		tMax := maptile.At(orb.Point{bound.Max.Lon(), bound.Min.Lat()}, z)
+
+		for x := tMin.X; x <= tMax.X; x++ {
+			for y := tMin.Y; y <= tMax.Y; y++ {
+				url := fmt.Sprintf(layer.route, zoom, x, y)
+				if query != "" {
+					url += "?" + query
+				}
+
+				req := httptest.NewRequest(http.MethodGet, url, nil).WithContext(ctx)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+
+				if rec.Code != http.StatusOK {
+					log.Printf("export: skip tile %d/%d/%d: %d %s",
+						zoom, x, y, rec.Code, strings.TrimSpace(rec.Body.String()))
+					continue
+				}
+
+				data := rec.Body.Bytes()
+				if layer.format == "pbf" {
+					var err error
+					data, err = gzipData(data)
+					if err != nil {
+						return cnt, err
+					}
+				}
+
+				err := tw.PutTile(ctx, uint32(zoom), x, y, data)
+				if err != nil {
+					return cnt, err
+				}
+				cnt++
+			}
+		}
+	}
+
+	return cnt, nil
+}
+
+func parseBBox(s string) (orb.Bound, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return orb.Bound{}, fmt.Errorf("invalid bbox: %s", s)
+	}
+
+	vals := make([]float64, 4)
+	for idx, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return orb.Bound{}, fmt.Errorf("invalid bbox: %s", s)
+		}
+		vals[idx] = v
+	}
+
+	bound := orb.Bound{
+		Min: orb.Point{vals[0], vals[1]},
+		Max: orb.Point{vals[2], vals[3]},
+	}
+	if bound.Min.Lon() > bound.Max.Lon() || bound.Min.Lat() > bound.Max.Lat() {
+		return orb.Bound{}, fmt.Errorf("invalid bbox: %s", s)
+	}
+
+	return bound, nil
+}
+
+func gzipData(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_vectorLayersMetadata_1(t *testing.T) {
+	r := newRouter(newTestTerra(t))
+
+	testData := []struct {
+		layer string
+		query string
+		ids   []string
+	}{
+		{"contours", "interval=10", []string{"contours"}},
+		{"contours", "interval=10&split=1", []string{"contours", "contours_index"}},
+		{"isobands", "interval=50", []string{"isobands"}},
+	}
+
+	for _, tst := range testData {
+		layer := exportLayers[tst.layer]
+		values, err := url.ParseQuery(tst.query)
+		require.NoError(t, err)
+
+		value, err := vectorLayersMetadata(layer.vectorLayers(values))
+		require.NoError(t, err)
+		var metadata struct {
+			VectorLayers []vectorLayer `json:"vector_layers"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(value), &metadata))
+
+		fields := make(map[string]map[string]string)
+		var ids []string
+		for _, vl := range metadata.VectorLayers {
+			ids = append(ids, vl.ID)
+			fields[vl.ID] = vl.Fields
+		}
+		assert.Equal(t, tst.ids, ids, tst.query)
+
+		// metadata describes layers and properties of tiles
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf(layer.route, 14, 11583, 6049)+"?"+tst.query, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		layers, err := mvt.Unmarshal(rec.Body.Bytes())
+		require.NoError(t, err)
+
+		var names []string
+		for _, l := range layers {
+			names = append(names, l.Name)
+			require.NotEmpty(t, l.Features, l.Name)
+			for _, feat := range l.Features {
+				for name, v := range feat.Properties {
+					switch v.(type) {
+					case bool:
+						assert.Equal(t, "Boolean", fields[l.Name][name], name)
+					default:
+						assert.Equal(t, "Number", fields[l.Name][name], name)
+					}
+				}
+			}
+		}
+		sort.Strings(names)
+		assert.Equal(t, tst.ids, names, tst.query)
+	}
+
+	// raster layers have no vector layers
+	assert.Nil(t, exportLayers["terrain"].vectorLayers)
+}
@@ -69,7 +69,7 @@ func Benchmark_hillshade_1(b *testing.B) {
 
 	var imgOut image.Image
 	for n := 0; n < b.N; n++ {
-		imgOut, err = HillshadeImage(img, pixel_res, h_factor, altitude, azimuth)
+		imgOut, err = HillshadeImage(img, terrariumEncoding{}, pixel_res, h_factor, altitude, azimuth)
 		require.NoError(b, err)
 	}
 
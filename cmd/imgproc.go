@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"math"
 	"sync"
+
+	"github.com/lucasb-eyer/go-colorful"
 )
 
 func TransparentGrayscale(img image.Image) image.Image {
@@ -59,12 +62,84 @@ func TransparentGrayscale(img image.Image) image.Image {
 	return imgOut
 }
 
+type HillshadeShading string
+
+const (
+	HillshadeShadingStandard         HillshadeShading = "standard"
+	HillshadeShadingMultidirectional HillshadeShading = "multidirectional"
+	HillshadeShadingCombined         HillshadeShading = "combined"
+)
+
+// multidirectionalAzimuths are light directions of multidirectional
+// hillshade, same as of gdaldem -multidirectional
+var multidirectionalAzimuths = []float64{225, 270, 315, 360}
+
+// InvertGrayscale returns negative of grayscale image
+func InvertGrayscale(img image.Image) image.Image {
+	bounds := img.Bounds()
+
+	imgOut := image.NewGray(bounds)
+	draw.Draw(imgOut, bounds, img, bounds.Min, draw.Src)
+
+	for idx := range imgOut.Pix {
+		imgOut.Pix[idx] = 255 - imgOut.Pix[idx]
+	}
+
+	return imgOut
+}
+
+// HillshadeImage computes hillshade of single elevation tile image,
+// heights outside of the tile are taken from the nearest edge pixel
 func HillshadeImage(img image.Image,
+	dec ElevationDecoder,
 	pixel_res float64,
 	h_factor float64,
 	altitude float64,
 	azimuth float64) (image.Image, error) {
 
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	elevData, err := dec.DecodeElevation(img)
+	if err != nil {
+		return nil, err
+	}
+
+	winData := make([]float64, (width+2)*(height+2))
+	idx := 0
+	for y := -1; y <= height; y++ {
+		yc := clampInt(y, 0, height-1)
+		for x := -1; x <= width; x++ {
+			xc := clampInt(x, 0, width-1)
+			winData[idx] = elevData[yc*width+xc]
+			idx++
+		}
+	}
+
+	return HillshadeElevation(winData, width+2, height+2, 1, pixel_res, h_factor, altitude, azimuth, HillshadeShadingStandard)
+}
+
+// HillshadeElevation computes hillshade of elevation window, which is
+// row-major grid of heights extended by border pixels on each side
+// (see getElevationWindow), so shading is continuous across tile edges.
+// Output image excludes the border.
+func HillshadeElevation(elevData []float64,
+	winWidth int,
+	winHeight int,
+	border int,
+	pixel_res float64,
+	h_factor float64,
+	altitude float64,
+	azimuth float64,
+	shading HillshadeShading) (image.Image, error) {
+
+	if border < 1 {
+		return nil, fmt.Errorf("hillshade requires border of at least 1 pixel, got %d", border)
+	}
+	if len(elevData) != winWidth*winHeight {
+		return nil, fmt.Errorf("elevation data size %d does not match %dx%d", len(elevData), winWidth, winHeight)
+	}
+
 	//h_factor := 1.0
 	//altitude := 45.0
 	//azimuth := 315.0
@@ -78,12 +153,94 @@ func HillshadeImage(img image.Image,
 	azimuth_math := 360.0 - azimuth + 90.0
 	azimuth_rad := azimuth_math * math.Pi / 180.0
 
+	multiAzimuthRad := make([]float64, len(multidirectionalAzimuths))
+	for idx, az := range multidirectionalAzimuths {
+		multiAzimuthRad[idx] = (360.0 - az + 90.0) * math.Pi / 180.0
+	}
+
+	switch shading {
+	case HillshadeShadingStandard, HillshadeShadingMultidirectional, HillshadeShadingCombined:
+	default:
+		return nil, fmt.Errorf("unsupported hillshade shading: %s", shading)
+	}
+
+	width := winWidth - 2*border
+	height := winHeight - 2*border
+
+	upLeft := image.Point{0, 0}
+	lowRight := image.Point{width, height}
+
+	imgOut := image.NewGray(image.Rectangle{upLeft, lowRight})
+
+	var wg sync.WaitGroup
+	sem := make(chan bool, MaxConcurrency)
+
+	for y := 0; y < height; y++ {
+
+		wg.Add(1)
+		sem <- true
+
+		y := y
+
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			for x := 0; x < width; x++ {
+				dz_dx, dz_dy := hornGradient(elevData, winWidth, x+border, y+border, pixel_res)
+				slope_rad, aspect_rad := slopeAspect(dz_dx, dz_dy, h_factor)
+
+				shade := func(azimuth_rad float64) float64 {
+					return (cosZenithRad * math.Cos(slope_rad)) +
+						(sinZenithRad * math.Sin(slope_rad) * math.Cos(azimuth_rad-aspect_rad))
+				}
+
+				var v float64
+				switch shading {
+				case HillshadeShadingMultidirectional:
+					// weight of light direction is sin^2 of angle to aspect as of
+					// gdaldem (Mark, 1992), lights across the slope weigh most,
+					// weights of directions 45 degrees apart sum up to 2
+					for _, az_rad := range multiAzimuthRad {
+						w := math.Sin(az_rad - aspect_rad)
+						v += w * w * math.Max(0, shade(az_rad))
+					}
+					v /= 2
+				case HillshadeShadingCombined:
+					// hillshade darkened by slope
+					hs := math.Max(-1, math.Min(1, shade(azimuth_rad)))
+					v = 1 - math.Acos(hs)*slope_rad/(math.Pi*math.Pi/4)
+				default:
+					v = shade(azimuth_rad)
+				}
+
+				hillshade := math.Floor(255.0 * math.Min(1, v))
+				if hillshade < 0 {
+					hillshade = 0
+				}
+
+				col := color.Gray{uint8(hillshade)}
+				imgOut.Set(x, y, col)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return imgOut, nil
+}
+
+// hornGradient returns surface gradient at x, y of elevation window
+// by Horn's method, x, y must be at least 1 pixel away from window edges
+func hornGradient(elevData []float64, winWidth int, x int, y int, pixel_res float64) (float64, float64) {
 	// a d g
 	// b e h
 	// c f i
 
-	// dz/dx = ((c + 2f + i) - (a + 2d + g)) / (8 * pixel_res)
-	// dz/dy = ((g + 2h + i) - (a + 2b + c))/ (8 * pixel_res)
+	// dz/dx = ((g + 2h + i) - (a + 2b + c)) / (8 * pixel_res)
+	// dz/dy = ((c + 2f + i) - (a + 2d + g))/ (8 * pixel_res)
 	//
 	// slope = atan(z_factor * sqrt((dz/dx)^2 + (dz/dy)^2))
 	// aspect = atan2(dz/dy, -dz/dx)
@@ -103,142 +260,426 @@ func HillshadeImage(img image.Image,
 	//     else
 	//       Aspect_rad = Aspect_rad
 
-	bounds := img.Bounds()
-	width, height := bounds.Max.X, bounds.Max.Y
-	/*
-		getHeightAtPixel := func(img image.Image, x int, y int) float64 {
-			dr, dg, db, da := img.At(x, y).RGBA()
-			h := rgbaToHeight(dr, dg, db, da)
-			return h
-		}
-	*/
-	getHeightAtPixel := func(rgba *image.RGBA, x int, y int) float64 {
-		pix_idx := (y*width + x) * 4
-		pix := rgba.Pix[pix_idx : pix_idx+4]
-		dr := uint32(pix[0])
-		dg := uint32(pix[1])
-		db := uint32(pix[2])
-		da := uint32(pix[3])
+	getHeightAtPixel := func(x int, y int) float64 {
+		return elevData[y*winWidth+x]
+	}
+
+	// a(-1,-1) d(0,-1) g(1,-1)
+	// b(-1,0) e(0,0) h(1,0)
+	// c(-1,1) f(0,1) i(1,1)
+	a := getHeightAtPixel(x-1, y-1)
+	b := getHeightAtPixel(x-1, y)
+	c := getHeightAtPixel(x-1, y+1)
+	d := getHeightAtPixel(x, y-1)
+	f := getHeightAtPixel(x, y+1)
+	g := getHeightAtPixel(x+1, y-1)
+	h := getHeightAtPixel(x+1, y)
+	i := getHeightAtPixel(x+1, y+1)
+
+	dz_dx := ((g + 2*h + i) - (a + 2*b + c)) / (8 * pixel_res)
+	dz_dy := ((c + 2*f + i) - (a + 2*d + g)) / (8 * pixel_res)
+
+	return dz_dx, dz_dy
+}
 
-		h := rgbaToHeight(dr, dg, db, da)
-		return h
+// slopeAspect returns slope and aspect angles in radians of surface gradient,
+// aspect is math angle of downslope direction
+func slopeAspect(dz_dx float64, dz_dy float64, z_factor float64) (float64, float64) {
+	slope_rad := math.Atan(z_factor * math.Sqrt(dz_dx*dz_dx+dz_dy*dz_dy))
+
+	var aspect_rad float64
+	if dz_dx != 0.0 {
+		aspect_rad = math.Atan2(dz_dy, -dz_dx)
+		if aspect_rad < 0.0 {
+			aspect_rad += 2 * math.Pi
+		}
+	} else {
+		if dz_dy > 0 {
+			aspect_rad = math.Pi / 2
+		} else if dz_dy < 0.0 {
+			aspect_rad = 2*math.Pi - math.Pi/2
+		}
 	}
 
-	rgba := image.NewRGBA(bounds)
-	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	return slope_rad, aspect_rad
+}
 
-	upLeft := image.Point{0, 0}
-	lowRight := image.Point{width, height}
+// SlopeElevation renders slope in degrees of elevation window
+// (see HillshadeElevation) through color ramp
+func SlopeElevation(elevData []float64,
+	winWidth int,
+	winHeight int,
+	border int,
+	pixel_res float64,
+	ramp ColorRamp) (image.Image, error) {
 
-	imgOut := image.NewGray(image.Rectangle{upLeft, lowRight})
+	if border < 1 {
+		return nil, fmt.Errorf("slope requires border of at least 1 pixel, got %d", border)
+	}
+	if len(elevData) != winWidth*winHeight {
+		return nil, fmt.Errorf("elevation data size %d does not match %dx%d", len(elevData), winWidth, winHeight)
+	}
+
+	width := winWidth - 2*border
+	height := winHeight - 2*border
+
+	imgOut := image.NewNRGBA(image.Rect(0, 0, width, height))
 
 	var wg sync.WaitGroup
 	sem := make(chan bool, MaxConcurrency)
 
-	// a(-1,-1) d(0,-1) g(1,-1)
-	// b(-1,0) e(0,0) h(1,0)
-	// c(-1,1) f(0,1) i(1,1)
-	for y := 1; y < height-1; y++ {
-
+	for y := 0; y < height; y++ {
 		wg.Add(1)
 		sem <- true
 
 		y := y
-
 		go func() {
 			defer func() {
 				<-sem
 				wg.Done()
 			}()
 
-			for x := 1; x < width-1; x++ {
+			for x := 0; x < width; x++ {
+				dz_dx, dz_dy := hornGradient(elevData, winWidth, x+border, y+border, pixel_res)
+				slope_rad, _ := slopeAspect(dz_dx, dz_dy, 1.0)
+				imgOut.Set(x, y, ramp.ValueToColor(slope_rad*180.0/math.Pi))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return imgOut, nil
+}
 
-				a := getHeightAtPixel(rgba, x-1, y-1)
-				b := getHeightAtPixel(rgba, x-1, y)
-				c := getHeightAtPixel(rgba, x-1, y+1)
-				d := getHeightAtPixel(rgba, x, y-1)
-				f := getHeightAtPixel(rgba, x, y+1)
-				g := getHeightAtPixel(rgba, x+1, y-1)
-				h := getHeightAtPixel(rgba, x+1, y)
-				i := getHeightAtPixel(rgba, x+1, y+1)
+// AspectElevation renders compass direction of downslope of elevation
+// window (see HillshadeElevation) as hue, north is red, east yellow-green,
+// south cyan and west violet. Pixels with slope below minSlope degrees
+// are transparent.
+func AspectElevation(elevData []float64,
+	winWidth int,
+	winHeight int,
+	border int,
+	pixel_res float64,
+	minSlope float64) (image.Image, error) {
 
-				dz_dx := ((c + 2*f + i) - (a + 2*d + g)) / (8 * pixel_res)
-				dz_dy := ((g + 2*h + i) - (a + 2*b + c)) / (8 * pixel_res)
+	if border < 1 {
+		return nil, fmt.Errorf("aspect requires border of at least 1 pixel, got %d", border)
+	}
+	if len(elevData) != winWidth*winHeight {
+		return nil, fmt.Errorf("elevation data size %d does not match %dx%d", len(elevData), winWidth, winHeight)
+	}
 
-				slope_rad := math.Atan(h_factor * math.Sqrt(dz_dx*dz_dx+dz_dy*dz_dy))
+	width := winWidth - 2*border
+	height := winHeight - 2*border
 
-				var aspect_rad float64
-				if dz_dx != 0.0 {
-					aspect_rad = math.Atan2(dz_dy, -dz_dx)
-					if aspect_rad < 0.0 {
-						aspect_rad += 2 * math.Pi
-					}
-				} else {
-					if dz_dy > 0 {
-						aspect_rad = math.Pi / 2
-					} else if dz_dy < 0.0 {
-						aspect_rad = 2*math.Pi - math.Pi/2
-					}
-				}
+	imgOut := image.NewNRGBA(image.Rect(0, 0, width, height))
 
-				hillshade := math.Floor(255.0 * ((cosZenithRad * math.Cos(slope_rad)) +
-					(sinZenithRad * math.Sin(slope_rad) * math.Cos(azimuth_rad-aspect_rad))))
-				if hillshade < 0 {
-					hillshade = 0
-				}
+	var wg sync.WaitGroup
+	sem := make(chan bool, MaxConcurrency)
 
-				col := color.Gray{uint8(hillshade)}
-				imgOut.Set(x, y, col)
+	for y := 0; y < height; y++ {
+		wg.Add(1)
+		sem <- true
+
+		y := y
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			for x := 0; x < width; x++ {
+				dz_dx, dz_dy := hornGradient(elevData, winWidth, x+border, y+border, pixel_res)
+				if dz_dx == 0 && dz_dy == 0 {
+					continue
+				}
+				slope_rad, aspect_rad := slopeAspect(dz_dx, dz_dy, 1.0)
+				if slope_rad*180.0/math.Pi < minSlope {
+					continue
+				}
+				imgOut.Set(x, y, aspectToColor(aspect_rad))
 			}
 		}()
 	}
-
 	wg.Wait()
 
-	// fixup artefacts along lines - copy shade from neighbour
-	y := 0
-	for x := 0; x < width; x++ {
-		col := imgOut.At(x, y+1)
-		imgOut.Set(x, y, col)
+	return imgOut, nil
+}
+
+// aspectToColor maps math angle of aspect to hue of compass direction
+func aspectToColor(aspect_rad float64) color.Color {
+	compass := math.Mod(450.0-aspect_rad*180.0/math.Pi, 360.0)
+	return colorful.Hsv(compass, 0.8, 0.9).Clamped()
+}
+
+type CurvatureKind string
+
+const (
+	CurvatureProfile CurvatureKind = "profile"
+	CurvaturePlan    CurvatureKind = "plan"
+)
+
+// CurvatureElevation computes profile or plan curvature in 1/m of elevation
+// window (see HillshadeElevation) by Zevenbergen-Thorne method.
+// Positive values are convex (profile in downslope direction, plan across
+// slope), negative are concave. Returns row-major grid without the border
+// and its size.
+func CurvatureElevation(elevData []float64,
+	winWidth int,
+	winHeight int,
+	border int,
+	pixel_res float64,
+	kind CurvatureKind) ([]float64, int, int, error) {
+
+	if border < 1 {
+		return nil, 0, 0, fmt.Errorf("curvature requires border of at least 1 pixel, got %d", border)
+	}
+	if len(elevData) != winWidth*winHeight {
+		return nil, 0, 0, fmt.Errorf("elevation data size %d does not match %dx%d", len(elevData), winWidth, winHeight)
+	}
+
+	var curvature func(d, e, f, g, h float64) float64
+	switch kind {
+	case CurvatureProfile:
+		curvature = func(d, e, f, g, h float64) float64 {
+			return -2 * (d*g*g + e*h*h + f*g*h) / (g*g + h*h)
+		}
+	case CurvaturePlan:
+		curvature = func(d, e, f, g, h float64) float64 {
+			return -2 * (d*h*h + e*g*g - f*g*h) / (g*g + h*h)
+		}
+	default:
+		return nil, 0, 0, fmt.Errorf("unsupported curvature: %s", kind)
 	}
-	y = height - 1
-	for x := 0; x < width; x++ {
-		col := imgOut.At(x, y-1)
-		imgOut.Set(x, y, col)
+
+	width := winWidth - 2*border
+	height := winHeight - 2*border
+
+	data := make([]float64, width*height)
+
+	l := pixel_res
+	l2 := l * l
+
+	getHeightAtPixel := func(x int, y int) float64 {
+		return elevData[y*winWidth+x]
 	}
-	x := 0
+
+	// z1 z2 z3
+	// z4 z5 z6
+	// z7 z8 z9
 	for y := 0; y < height; y++ {
-		col := imgOut.At(x+1, y)
-		imgOut.Set(x, y, col)
+		for x := 0; x < width; x++ {
+			wx, wy := x+border, y+border
+
+			z1 := getHeightAtPixel(wx-1, wy-1)
+			z2 := getHeightAtPixel(wx, wy-1)
+			z3 := getHeightAtPixel(wx+1, wy-1)
+			z4 := getHeightAtPixel(wx-1, wy)
+			z5 := getHeightAtPixel(wx, wy)
+			z6 := getHeightAtPixel(wx+1, wy)
+			z7 := getHeightAtPixel(wx-1, wy+1)
+			z8 := getHeightAtPixel(wx, wy+1)
+			z9 := getHeightAtPixel(wx+1, wy+1)
+
+			d := ((z4+z6)/2 - z5) / l2
+			e := ((z2+z8)/2 - z5) / l2
+			f := (-z1 + z3 + z7 - z9) / (4 * l2)
+			g := (-z4 + z6) / (2 * l)
+			h := (z2 - z8) / (2 * l)
+
+			// curvature is undefined on flat surface
+			if g == 0 && h == 0 {
+				continue
+			}
+
+			data[y*width+x] = curvature(d, e, f, g, h)
+		}
+	}
+
+	return data, width, height, nil
+}
+
+// summedAreaTable keeps sums of heights and squared heights
+// of elevation window for constant time neighbourhood statistics.
+// Heights are taken relative to window mean ref, so that squared
+// sums do not lose precision at high elevations
+type summedAreaTable struct {
+	width int
+	ref   float64
+	sum   []float64
+	sumSq []float64
+}
+
+func newSummedAreaTable(elevData []float64, winWidth int, winHeight int) *summedAreaTable {
+	// one extra zero row and column simplify rectangle sums
+	w := winWidth + 1
+	sat := summedAreaTable{
+		width: w,
+		sum:   make([]float64, w*(winHeight+1)),
+		sumSq: make([]float64, w*(winHeight+1)),
+	}
+
+	for _, h := range elevData {
+		sat.ref += h
+	}
+	if len(elevData) > 0 {
+		sat.ref /= float64(len(elevData))
+	}
+
+	for y := 0; y < winHeight; y++ {
+		rowSum, rowSumSq := 0.0, 0.0
+		for x := 0; x < winWidth; x++ {
+			h := elevData[y*winWidth+x] - sat.ref
+			rowSum += h
+			rowSumSq += h * h
+			idx := (y+1)*w + x + 1
+			sat.sum[idx] = sat.sum[idx-w] + rowSum
+			sat.sumSq[idx] = sat.sumSq[idx-w] + rowSumSq
+		}
+	}
+
+	return &sat
+}
+
+// rect returns sum of heights and squared heights relative to ref
+// of window pixels x0 <= x <= x1, y0 <= y <= y1
+func (sat *summedAreaTable) rect(x0 int, y0 int, x1 int, y1 int) (float64, float64) {
+	w := sat.width
+	a, b := y0*w+x0, y0*w+x1+1
+	c, d := (y1+1)*w+x0, (y1+1)*w+x1+1
+	return sat.sum[d] - sat.sum[b] - sat.sum[c] + sat.sum[a],
+		sat.sumSq[d] - sat.sumSq[b] - sat.sumSq[c] + sat.sumSq[a]
+}
+
+// neighbourhoodIndexImage renders index computed from height and sums
+// of heights and squared heights of square neighbourhood of radius pixels
+// (excluding the center) through color ramp. Heights passed to index are
+// relative to window mean, index must not depend on height offset
+func neighbourhoodIndexImage(elevData []float64,
+	winWidth int,
+	winHeight int,
+	border int,
+	radius int,
+	ramp ColorRamp,
+	index func(h float64, sum float64, sumSq float64, n float64) float64) (image.Image, error) {
+
+	if radius < 1 || radius > border {
+		return nil, fmt.Errorf("invalid neighbourhood radius %d for window border %d", radius, border)
+	}
+	if len(elevData) != winWidth*winHeight {
+		return nil, fmt.Errorf("elevation data size %d does not match %dx%d", len(elevData), winWidth, winHeight)
 	}
-	x = width - 1
+
+	sat := newSummedAreaTable(elevData, winWidth, winHeight)
+
+	width := winWidth - 2*border
+	height := winHeight - 2*border
+	n := float64((2*radius+1)*(2*radius+1) - 1)
+
+	imgOut := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	var wg sync.WaitGroup
+	sem := make(chan bool, MaxConcurrency)
+
 	for y := 0; y < height; y++ {
-		col := imgOut.At(x-1, y)
-		imgOut.Set(x, y, col)
+		wg.Add(1)
+		sem <- true
+
+		y := y
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			for x := 0; x < width; x++ {
+				wx, wy := x+border, y+border
+				h := elevData[wy*winWidth+wx] - sat.ref
+				sum, sumSq := sat.rect(wx-radius, wy-radius, wx+radius, wy+radius)
+				v := index(h, sum-h, sumSq-h*h, n)
+				imgOut.Set(x, y, ramp.ValueToColor(v))
+			}
+		}()
 	}
+	wg.Wait()
 
 	return imgOut, nil
 }
 
-func ColorReliefImage(img image.Image, gm *gradientMap) (image.Image, error) {
+// TRIElevation renders terrain ruggedness index of Riley et al. (1999),
+// square root of sum of squared height differences between pixel and its
+// neighbours within radius pixels
+func TRIElevation(elevData []float64,
+	winWidth int,
+	winHeight int,
+	border int,
+	radius int,
+	ramp ColorRamp) (image.Image, error) {
+
+	return neighbourhoodIndexImage(elevData, winWidth, winHeight, border, radius, ramp,
+		func(h float64, sum float64, sumSq float64, n float64) float64 {
+			// sum((z - h)^2) = sum(z^2) - 2 * h * sum(z) + n * h^2
+			sqDiff := sumSq - 2*h*sum + n*h*h
+			return math.Sqrt(math.Max(0, sqDiff))
+		})
+}
+
+// TPIElevation renders topographic position index, difference between
+// pixel height and mean height of its neighbours within radius pixels
+func TPIElevation(elevData []float64,
+	winWidth int,
+	winHeight int,
+	border int,
+	radius int,
+	ramp ColorRamp) (image.Image, error) {
+
+	return neighbourhoodIndexImage(elevData, winWidth, winHeight, border, radius, ramp,
+		func(h float64, sum float64, sumSq float64, n float64) float64 {
+			return h - sum/n
+		})
+}
+
+func clampInt(v int, min int, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func ColorReliefImage(img image.Image, dec ElevationDecoder, ramp ColorRamp) (image.Image, error) {
 
 	bounds := img.Bounds()
-	width, height := bounds.Max.X, bounds.Max.Y
+	width, height := bounds.Dx(), bounds.Dy()
 
-	getHeightAtPixel := func(rgba *image.RGBA, x int, y int) float64 {
-		pix_idx := (y*width + x) * 4
-		pix := rgba.Pix[pix_idx : pix_idx+4]
-		dr := uint32(pix[0])
-		dg := uint32(pix[1])
-		db := uint32(pix[2])
-		da := uint32(pix[3])
+	elevData, err := dec.DecodeElevation(img)
+	if err != nil {
+		return nil, err
+	}
+
+	return ColorReliefElevation(elevData, width, height, 0, ramp)
+}
+
+// ColorReliefElevation colors elevation window by ramp,
+// output image excludes the border
+func ColorReliefElevation(elevData []float64,
+	winWidth int,
+	winHeight int,
+	border int,
+	ramp ColorRamp) (image.Image, error) {
 
-		h := rgbaToHeight(dr, dg, db, da)
-		return h
+	if len(elevData) != winWidth*winHeight {
+		return nil, fmt.Errorf("elevation data size %d does not match %dx%d", len(elevData), winWidth, winHeight)
 	}
 
-	rgba := image.NewRGBA(bounds)
-	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	width := winWidth - 2*border
+	height := winHeight - 2*border
+
+	getHeightAtPixel := func(x int, y int) float64 {
+		return elevData[(y+border)*winWidth+x+border]
+	}
 
 	upLeft := image.Point{0, 0}
 	lowRight := image.Point{width, height}
@@ -260,9 +701,9 @@ func ColorReliefImage(img image.Image, gm *gradientMap) (image.Image, error) {
 			}()
 
 			for x := 0; x < width; x++ {
-				h := getHeightAtPixel(rgba, x, y)
+				h := getHeightAtPixel(x, y)
 				//col := keypoints.HeightToColor(h)
-				col := gm.HeightToColor(h)
+				col := ramp.ValueToColor(h)
 				imgOut.Set(x, y, col)
 			}
 		}()
@@ -271,3 +712,73 @@ func ColorReliefImage(img image.Image, gm *gradientMap) (image.Image, error) {
 
 	return imgOut, nil
 }
+
+// BlendMode is how hillshade is blended onto color tint
+type BlendMode string
+
+const (
+	BlendMultiply  BlendMode = "multiply"
+	BlendOverlay   BlendMode = "overlay"
+	BlendSoftLight BlendMode = "soft-light"
+)
+
+// blend combines tint and shade channels in range 0-1
+func (bm BlendMode) blend(tint float64, shade float64) float64 {
+	switch bm {
+	case BlendOverlay:
+		if tint < 0.5 {
+			return 2 * tint * shade
+		}
+		return 1 - 2*(1-tint)*(1-shade)
+	case BlendSoftLight:
+		return (1-2*shade)*tint*tint + 2*shade*tint
+	}
+	return tint * shade
+}
+
+// ShadedReliefImage blends grayscale hillshade onto color tint of the same
+// size, opacity (0-1) is strength of shading, tint transparency is kept
+func ShadedReliefImage(tint image.Image, shade image.Image, mode BlendMode, opacity float64) (image.Image, error) {
+	bounds := tint.Bounds()
+	if bounds.Size() != shade.Bounds().Size() {
+		return nil, fmt.Errorf("hillshade size %v does not match tint size %v", shade.Bounds().Size(), bounds.Size())
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+
+	tintNRGBA := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(tintNRGBA, tintNRGBA.Bounds(), tint, bounds.Min, draw.Src)
+	shadeGray := image.NewGray(image.Rect(0, 0, width, height))
+	draw.Draw(shadeGray, shadeGray.Bounds(), shade, shade.Bounds().Min, draw.Src)
+
+	imgOut := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	var wg sync.WaitGroup
+	sem := make(chan bool, MaxConcurrency)
+
+	for y := 0; y < height; y++ {
+		wg.Add(1)
+		sem <- true
+
+		y := y
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			for x := 0; x < width; x++ {
+				s := float64(shadeGray.Pix[y*shadeGray.Stride+x]) / 255
+				pix_idx := y*tintNRGBA.Stride + x*4
+				for c := 0; c < 3; c++ {
+					t := float64(tintNRGBA.Pix[pix_idx+c]) / 255
+					v := t + opacity*(mode.blend(t, s)-t)
+					imgOut.Pix[pix_idx+c] = uint8(math.Round(255 * math.Max(0, math.Min(1, v))))
+				}
+				imgOut.Pix[pix_idx+3] = tintNRGBA.Pix[pix_idx+3]
+			}
+		}()
+	}
+	wg.Wait()
+
+	return imgOut, nil
+}
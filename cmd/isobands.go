@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/fogleman/contourmap"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/clip"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/planar"
+	"github.com/valri11/surfacemap/slippymath"
+)
+
+// isoband is area of elevation in range minElevation < h <= maxElevation
+type isoband struct {
+	minElevation float64
+	maxElevation float64
+	polygons     orb.MultiPolygon
+}
+
+// Isobands computes filled elevation bands of interval of row-major grid,
+// polygons are in pixel coordinates of the grid and closed at grid edges
+func Isobands(data []float64, width int, height int, interval float64) ([]isoband, error) {
+	if len(data) != width*height {
+		return nil, fmt.Errorf("elevation data size %d does not match %dx%d", len(data), width, height)
+	}
+	if !(interval > 0) {
+		return nil, fmt.Errorf("invalid interval: %v", interval)
+	}
+
+	z0, z1 := math.Inf(1), math.Inf(-1)
+	for _, v := range data {
+		z0 = math.Min(z0, v)
+		z1 = math.Max(z1, v)
+	}
+
+	// lowest band includes minimal elevation
+	zLevel := math.Floor(z0/interval) * interval
+	if zLevel >= z0 {
+		zLevel -= interval
+	}
+	if (z1-zLevel)/interval > maxContourLevels {
+		return nil, fmt.Errorf("interval %v is too small for elevation range %v-%v", interval, z0, z1)
+	}
+
+	// grid padded by value below all levels has isolines closed around
+	// grid edges, isolines of different levels do not touch
+	padded := make([]float64, (width+2)*(height+2))
+	for idx := range padded {
+		padded[idx] = zLevel - interval
+	}
+	for y := 0; y < height; y++ {
+		copy(padded[(y+1)*(width+2)+1:], data[y*width:(y+1)*width])
+	}
+	paddedMap := contourmap.FromFloat64s(width+2, height+2, padded)
+
+	gridBound := orb.Bound{Max: orb.Point{float64(width - 1), float64(height - 1)}}
+
+	var bands []isoband
+	lower := isolineRings(paddedMap, zLevel)
+	for zLevel < z1 {
+		upper := isolineRings(paddedMap, zLevel+interval)
+
+		// band is area between rings of its bounds
+		rings := make([]orb.Ring, 0, len(lower)+len(upper))
+		rings = append(rings, lower...)
+		rings = append(rings, upper...)
+		polygons := clipPolygons(gridBound, evenOddPolygons(rings))
+		if len(polygons) > 0 {
+			bands = append(bands, isoband{
+				minElevation: zLevel,
+				maxElevation: zLevel + interval,
+				polygons:     polygons,
+			})
+		}
+
+		lower = upper
+		zLevel += interval
+	}
+
+	return bands, nil
+}
+
+// isolineRings returns closed isolines of padded contour map
+// in pixel coordinates of the grid
+func isolineRings(paddedMap *contourmap.ContourMap, z float64) []orb.Ring {
+	var rings []orb.Ring
+	for _, contour := range paddedMap.Contours(z) {
+		if len(contour) < 3 {
+			continue
+		}
+		ring := make(orb.Ring, 0, len(contour)+1)
+		for _, point := range contour {
+			ring = append(ring, orb.Point{point.X - 1, point.Y - 1})
+		}
+		if !ring.Closed() {
+			ring = append(ring, ring[0])
+		}
+		rings = append(rings, ring)
+	}
+	return rings
+}
+
+// evenOddPolygons assembles polygons of non-crossing rings, ring nested in
+// even number of rings is exterior, in odd number is hole of its parent
+func evenOddPolygons(rings []orb.Ring) orb.MultiPolygon {
+	bounds := make([]orb.Bound, len(rings))
+	for idx, ring := range rings {
+		bounds[idx] = ring.Bound()
+	}
+
+	depth := make([]int, len(rings))
+	parent := make([]int, len(rings))
+	containers := make([][]int, len(rings))
+	for i := range rings {
+		for j := range rings {
+			if i == j || !bounds[j].Contains(rings[i][0]) {
+				continue
+			}
+			if planar.RingContains(rings[j], rings[i][0]) {
+				containers[i] = append(containers[i], j)
+			}
+		}
+		depth[i] = len(containers[i])
+	}
+	// parent is the innermost container
+	for i := range rings {
+		parent[i] = -1
+		for _, j := range containers[i] {
+			if parent[i] < 0 || depth[j] > depth[parent[i]] {
+				parent[i] = j
+			}
+		}
+	}
+
+	polygonIdx := make(map[int]int)
+	var polygons orb.MultiPolygon
+	for i, ring := range rings {
+		if depth[i]%2 == 0 {
+			polygonIdx[i] = len(polygons)
+			polygons = append(polygons, orb.Polygon{ring})
+		}
+	}
+	for i, ring := range rings {
+		if depth[i]%2 == 1 {
+			pIdx := polygonIdx[parent[i]]
+			polygons[pIdx] = append(polygons[pIdx], ring)
+		}
+	}
+
+	return polygons
+}
+
+// clipPolygons clips polygons to bound with rings closed, polygons
+// with no area inside the bound are removed
+func clipPolygons(b orb.Bound, mp orb.MultiPolygon) orb.MultiPolygon {
+	var out orb.MultiPolygon
+	for _, p := range clip.MultiPolygon(b, mp.Clone()) {
+		for idx, ring := range p {
+			if len(ring) > 0 && !ring.Closed() {
+				p[idx] = append(ring, ring[0])
+			}
+		}
+		if planar.Area(p) > epsilon {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// tilesIsobandsHandler serves filled elevation bands of interval
+// clipped to the tile as GeoJSON or MVT (layer isobands)
+func (h *terra) tilesIsobandsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	params, err := h.getRequestContourParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	zoom, tile_X, tile_Y, lvlInterval := params.zoom, params.tile_X, params.tile_Y, params.interval
+
+	log.Printf("Isobands params: z=%v, x=%v, y=%v, interval=%v%s\n",
+		zoom, tile_X, tile_Y, lvlInterval, params.units)
+
+	dtStart := time.Now()
+
+	const off_px = 3
+
+	windowedData, width, height, err := h.getElevationWindowUnits(ctx, params.units, zoom, tile_X, tile_Y, off_px)
+	if err != nil {
+		log.Printf("req: ERR: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bands, err := Isobands(windowedData, width, height, lvlInterval)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tileBound := orb.Bound{
+		Min: orb.Point{off_px, off_px},
+		Max: orb.Point{off_px + TileSize, off_px + TileSize},
+	}
+	toLonLat := func(pt orb.Point) orb.Point {
+		lon, lat := slippymath.TileToLonLat(
+			uint32(zoom+8),
+			float64(tile_X*TileSize)+pt[0]-off_px, float64(tile_Y*TileSize)+pt[1]-off_px)
+		return orb.Point{lon, lat}
+	}
+
+	fc := geojson.NewFeatureCollection()
+	for _, band := range bands {
+		mp := clipPolygons(tileBound, band.polygons)
+		if len(mp) == 0 {
+			continue
+		}
+		for _, p := range mp {
+			for _, ring := range p {
+				for idx, pt := range ring {
+					ring[idx] = toLonLat(pt)
+				}
+			}
+		}
+
+		feat := geojson.NewFeature(mp)
+		feat.Properties["min_elevation"] = band.minElevation
+		feat.Properties["max_elevation"] = band.maxElevation
+		fc.Append(feat)
+	}
+
+	out, contentType, err := encodeFeatureLayers(map[string]*geojson.FeatureCollection{"isobands": fc},
+		params.outFormat, zoom, tile_X, tile_Y)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dt2 := time.Now()
+	log.Printf("Isobands completed in %v\n", dt2.Sub(dtStart))
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(out)
+}
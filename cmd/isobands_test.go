@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+	"github.com/paulmach/orb/planar"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// coneGrid returns grid of cone of height 100 at center descending to 0
+func coneGrid(size int) []float64 {
+	data := make([]float64, size*size)
+	c := float64(size-1) / 2
+	for idx := range data {
+		dx := float64(idx%size) - c
+		dy := float64(idx/size) - c
+		data[idx] = math.Max(0, 100-100*math.Hypot(dx, dy)/c)
+	}
+	return data
+}
+
+func Test_Isobands_cone(t *testing.T) {
+	const size = 41
+	bands, err := Isobands(coneGrid(size), size, size, 25)
+	require.NoError(t, err)
+	require.Len(t, bands, 5)
+
+	center := orb.Point{(size - 1) / 2, (size - 1) / 2}
+
+	totalArea := 0.0
+	for idx, band := range bands {
+		assert.Equal(t, float64(idx-1)*25, band.minElevation)
+		assert.Equal(t, float64(idx)*25, band.maxElevation)
+
+		totalArea += planar.Area(band.polygons)
+
+		// cone bands are rings around the peak
+		require.Len(t, band.polygons, 1)
+		inner := len(band.polygons[0]) - 1
+		if band.maxElevation < 100 {
+			assert.Equal(t, 1, inner, "band %v", band.maxElevation)
+		} else {
+			assert.Equal(t, 0, inner)
+		}
+		assert.Equal(t, band.maxElevation == 100, planar.PolygonContains(band.polygons[0], center), "band %v", band.maxElevation)
+	}
+	// bands cover the whole grid without overlaps
+	assert.InDelta(t, float64((size-1)*(size-1)), totalArea, 1e-6)
+
+	_, err = Isobands(coneGrid(size), size, size, 0)
+	assert.Error(t, err)
+}
+
+func Test_Isobands_hole(t *testing.T) {
+	// plateau with pit, pit is hole of plateau band
+	const size = 20
+	data := make([]float64, size*size)
+	for idx := range data {
+		x, y := idx%size, idx/size
+		switch {
+		case x >= 8 && x <= 11 && y >= 8 && y <= 11:
+			data[idx] = 5
+		case x >= 3 && x <= 16 && y >= 3 && y <= 16:
+			data[idx] = 50
+		default:
+			data[idx] = 20
+		}
+	}
+
+	bands, err := Isobands(data, size, size, 10)
+	require.NoError(t, err)
+
+	for _, band := range bands {
+		switch band.maxElevation {
+		case 10:
+			require.Len(t, band.polygons, 1)
+			assert.True(t, planar.PolygonContains(band.polygons[0], orb.Point{9.5, 9.5}))
+		case 50:
+			require.Len(t, band.polygons, 1)
+			require.Len(t, band.polygons[0], 2)
+			assert.False(t, planar.PolygonContains(band.polygons[0], orb.Point{9.5, 9.5}))
+			assert.True(t, planar.PolygonContains(band.polygons[0], orb.Point{4, 4}))
+		case 20:
+			// lowest band of outer area has holes of plateau and pit
+			require.Len(t, band.polygons, 2)
+		}
+	}
+}
+
+func Test_tilesIsobandsHandler_1(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/isobands/14/11583/6049.geojson?interval=50", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	fc, err := geojson.UnmarshalFeatureCollection(rec.Body.Bytes())
+	require.NoError(t, err)
+	require.NotEmpty(t, fc.Features)
+
+	tileBound := maptile.New(11583, 6049, 14).Bound()
+	totalArea := 0.0
+	for _, feat := range fc.Features {
+		minElevation := feat.Properties.MustFloat64("min_elevation")
+		assert.Equal(t, minElevation+50, feat.Properties.MustFloat64("max_elevation"))
+
+		mp, ok := feat.Geometry.(orb.MultiPolygon)
+		require.True(t, ok)
+		for _, p := range mp {
+			require.Equal(t, orb.CCW, p[0].Orientation(), p)
+			for _, ring := range p {
+				assert.True(t, ring.Closed())
+				for _, pt := range ring {
+					require.True(t, tileBound.Pad(1e-9).Contains(pt), "%v %v", pt, tileBound)
+				}
+			}
+		}
+		totalArea += planar.Area(mp)
+	}
+	// bands are clipped to the tile and cover it
+	assert.InDelta(t, planar.Area(tileBound), totalArea, planar.Area(tileBound)*1e-6)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/isobands/14/11583/6049.mvt?interval=50", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/vnd.mapbox-vector-tile", rec.Header().Get("Content-Type"))
+
+	layers, err := mvt.Unmarshal(rec.Body.Bytes())
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	assert.Equal(t, "isobands", layers[0].Name)
+	assert.NotEmpty(t, layers[0].Features)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/isobands/14/11583/6049.kml", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
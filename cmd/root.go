@@ -6,6 +6,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -58,6 +59,8 @@ func initConfig() {
 		viper.SetConfigName(".surfacemap")
 	}
 
+	// nested keys are read from env with underscores, e.g. S3_ENDPOINT for s3.endpoint
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_", "-", "_"))
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
@@ -0,0 +1,313 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/valri11/surfacemap/slippymath"
+)
+
+// maxNeighbourhoodRadius limits window of neighbourhood indexes
+// to the tile and its direct neighbours
+const maxNeighbourhoodRadius = TileSize
+
+// elevationWindowRenderer renders output tile from elevation window
+// extended by border pixels from neighbour tiles
+type elevationWindowRenderer func(elevData []float64, winWidth int, winHeight int, border int, pixel_res float64) (image.Image, error)
+
+// elevationWindowEncoder encodes output tile from elevation window
+// extended by border pixels from neighbour tiles, returns tile data
+// and its content type
+type elevationWindowEncoder func(elevData []float64, winWidth int, winHeight int, border int, pixel_res float64) ([]byte, string, error)
+
+// terrainAnalysisHandler serves PNG tile rendered from elevation window of requested tile
+func (h *terra) terrainAnalysisHandler(w http.ResponseWriter,
+	r *http.Request,
+	name string,
+	border int,
+	render elevationWindowRenderer) {
+
+	h.terrainWindowHandler(w, r, name, border,
+		func(elevData []float64, winWidth int, winHeight int, border int, pixel_res float64) ([]byte, string, error) {
+			imgOut, err := render(elevData, winWidth, winHeight, border, pixel_res)
+			if err != nil {
+				return nil, "", err
+			}
+
+			buf := new(bytes.Buffer)
+			err = png.Encode(buf, imgOut)
+			if err != nil {
+				return nil, "", err
+			}
+			return buf.Bytes(), "image/png", nil
+		})
+}
+
+// terrainWindowHandler serves tile encoded from elevation window of requested tile
+func (h *terra) terrainWindowHandler(w http.ResponseWriter,
+	r *http.Request,
+	name string,
+	border int,
+	encode elevationWindowEncoder) {
+
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+
+	log.Printf("%s params: z=%v, x=%v, y=%v\n", name, vars["z"], vars["x"], vars["y"])
+
+	z, err := strconv.Atoi(vars["z"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	x, err := strconv.Atoi(vars["x"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	y, err := strconv.Atoi(vars["y"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	elevData, winWidth, winHeight, err := h.getElevationWindow(ctx, z, x, y, border)
+	if err != nil {
+		log.Printf("req: ERR: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dt1 := time.Now()
+	pixel_res, err := slippymath.TilePixelResolution(uint32(z), float64(x), float64(y))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	out, contentType, err := encode(elevData, winWidth, winHeight, border, pixel_res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dt2 := time.Now()
+	log.Printf("%s completed in %v", name, dt2.Sub(dt1))
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "max-age:28800, public")
+	cacheSince := time.Now().Format(http.TimeFormat)
+	cacheUntil := time.Now().Add(8 * time.Hour).Format(http.TimeFormat)
+	w.Header().Set("Last-Modified", cacheSince)
+	w.Header().Set("Expires", cacheUntil)
+
+	w.Write(out)
+}
+
+// slopeHandler serves slope in degrees rendered by color ramp selected
+// by ramp query parameter (presets gradient, avalanche or configured ramp)
+func (h *terra) slopeHandler(w http.ResponseWriter, r *http.Request) {
+	rampName := r.URL.Query().Get("ramp")
+	if rampName == "" {
+		rampName = h.defaultSlopeRamp
+	}
+	ramp, ok := h.slopeRamps[rampName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown slope color ramp: %s", rampName), http.StatusBadRequest)
+		return
+	}
+
+	h.terrainAnalysisHandler(w, r, "Slope", 1,
+		func(elevData []float64, winWidth int, winHeight int, border int, pixel_res float64) (image.Image, error) {
+			return SlopeElevation(elevData, winWidth, winHeight, border, pixel_res, ramp)
+		})
+}
+
+// aspectHandler serves compass direction of slopes, slopes flatter than
+// min_slope query parameter (degrees, default 0) are transparent
+func (h *terra) aspectHandler(w http.ResponseWriter, r *http.Request) {
+	minSlope := 0.0
+	if v := r.URL.Query().Get("min_slope"); v != "" {
+		var err error
+		minSlope, err = strconv.ParseFloat(v, 64)
+		if err != nil || minSlope < 0 || minSlope > 90 {
+			http.Error(w, fmt.Sprintf("invalid min_slope: %s, expected value in range 0-90", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.terrainAnalysisHandler(w, r, "Aspect", 1,
+		func(elevData []float64, winWidth int, winHeight int, border int, pixel_res float64) (image.Image, error) {
+			return AspectElevation(elevData, winWidth, winHeight, border, pixel_res, minSlope)
+		})
+}
+
+// shadedReliefHandler serves color-relief tint of ramp query parameter
+// shaded by hillshade (see getRequestHillshadeParams, gray or inverted
+// mode) blended with blend mode (multiply, overlay, soft-light, default
+// multiply) and opacity (0-1, default 1)
+func (h *terra) shadedReliefHandler(w http.ResponseWriter, r *http.Request) {
+	ramp, err := h.getRequestReliefRamp(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params, err := getRequestHillshadeParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// tint alpha is kept, transparent hillshade has nothing to blend
+	if params.mode == HillshadeModeTransparent {
+		http.Error(w, "unsupported shaded relief hillshade mode: transparent", http.StatusBadRequest)
+		return
+	}
+
+	mode := BlendMultiply
+	if v := r.URL.Query().Get("blend"); v != "" {
+		switch BlendMode(v) {
+		case BlendMultiply, BlendOverlay, BlendSoftLight:
+			mode = BlendMode(v)
+		default:
+			http.Error(w, fmt.Sprintf("unsupported blend mode: %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	opacity := 1.0
+	if v := r.URL.Query().Get("opacity"); v != "" {
+		opacity, err = strconv.ParseFloat(v, 64)
+		if err != nil || !(opacity >= 0 && opacity <= 1) {
+			http.Error(w, fmt.Sprintf("invalid opacity: %s, expected value in range 0-1", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.terrainAnalysisHandler(w, r, "ShadedRelief", 1,
+		func(elevData []float64, winWidth int, winHeight int, border int, pixel_res float64) (image.Image, error) {
+			tint, err := ColorReliefElevation(elevData, winWidth, winHeight, border, ramp)
+			if err != nil {
+				return nil, err
+			}
+			shade, err := HillshadeElevation(elevData, winWidth, winHeight, border, pixel_res,
+				params.zFactor, params.altitude, params.azimuth, params.shading)
+			if err != nil {
+				return nil, err
+			}
+			if params.mode == HillshadeModeInverted {
+				shade = InvertGrayscale(shade)
+			}
+			return ShadedReliefImage(tint, shade, mode, opacity)
+		})
+}
+
+// getRequestRadius reads neighbourhood radius query parameter in pixels
+func getRequestRadius(r *http.Request) (int, error) {
+	radius := 1
+	if v := r.URL.Query().Get("radius"); v != "" {
+		var err error
+		radius, err = strconv.Atoi(v)
+		if err != nil || radius < 1 || radius > maxNeighbourhoodRadius {
+			return 0, fmt.Errorf("invalid radius: %s, expected value in range 1-%d", v, maxNeighbourhoodRadius)
+		}
+	}
+	return radius, nil
+}
+
+// triHandler serves terrain ruggedness index of Riley et al. (1999),
+// square root of sum of squared height differences to neighbours, of
+// neighbourhood of radius query parameter pixels (default 1)
+func (h *terra) triHandler(w http.ResponseWriter, r *http.Request) {
+	radius, err := getRequestRadius(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.terrainAnalysisHandler(w, r, "TRI", radius,
+		func(elevData []float64, winWidth int, winHeight int, border int, pixel_res float64) (image.Image, error) {
+			return TRIElevation(elevData, winWidth, winHeight, border, radius, h.triRamp)
+		})
+}
+
+// tpiHandler serves topographic position index of neighbourhood
+// of radius query parameter pixels (default 1)
+func (h *terra) tpiHandler(w http.ResponseWriter, r *http.Request) {
+	radius, err := getRequestRadius(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.terrainAnalysisHandler(w, r, "TPI", radius,
+		func(elevData []float64, winWidth int, winHeight int, border int, pixel_res float64) (image.Image, error) {
+			return TPIElevation(elevData, winWidth, winHeight, border, radius, h.tpiRamp)
+		})
+}
+
+// curvatureHandler serves profile or plan curvature as colourised PNG
+// or as raw little-endian float32 grid in 1/m (bin format)
+func (h *terra) curvatureHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	kind := CurvatureKind(vars["kind"])
+	switch kind {
+	case CurvatureProfile, CurvaturePlan:
+	default:
+		http.Error(w, fmt.Sprintf("unsupported curvature: %s", kind), http.StatusBadRequest)
+		return
+	}
+
+	format := vars["format"]
+	switch format {
+	case "png", "bin":
+	default:
+		http.Error(w, fmt.Sprintf("unsupported output format: %s", format), http.StatusBadRequest)
+		return
+	}
+
+	h.terrainWindowHandler(w, r, "Curvature", 1,
+		func(elevData []float64, winWidth int, winHeight int, border int, pixel_res float64) ([]byte, string, error) {
+			data, width, height, err := CurvatureElevation(elevData, winWidth, winHeight, border, pixel_res, kind)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if format == "bin" {
+				return encodeFloat32Grid(data), "application/octet-stream", nil
+			}
+
+			// ramp is in 1/100 m, same units as in GIS tools
+			imgOut := image.NewNRGBA(image.Rect(0, 0, width, height))
+			for idx, v := range data {
+				imgOut.Set(idx%width, idx/width, h.curvatureRamp.ValueToColor(v*100))
+			}
+
+			buf := new(bytes.Buffer)
+			err = png.Encode(buf, imgOut)
+			if err != nil {
+				return nil, "", err
+			}
+			return buf.Bytes(), "image/png", nil
+		})
+}
+
+// encodeFloat32Grid encodes row-major grid as little-endian float32 values
+func encodeFloat32Grid(data []float64) []byte {
+	out := make([]byte, 4*len(data))
+	for idx, v := range data {
+		binary.LittleEndian.PutUint32(out[idx*4:], math.Float32bits(float32(v)))
+	}
+	return out
+}
@@ -0,0 +1,454 @@
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lucasb-eyer/go-colorful"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valri11/surfacemap/slippymath"
+)
+
+// planeWindow returns elevation window of plane rising towards east by slope degrees
+func planeWindow(size int, pixel_res float64, slope float64) []float64 {
+	data := make([]float64, size*size)
+	for idx := range data {
+		data[idx] = float64(idx%size) * pixel_res * math.Tan(slope*math.Pi/180)
+	}
+	return data
+}
+
+func Test_SlopeElevation_1(t *testing.T) {
+	const size = 8
+	ramps, err := newSlopeRamps(nil)
+	require.NoError(t, err)
+
+	testData := []struct {
+		slope float64
+		col   color.Color
+	}{
+		{20, color.NRGBA{}},
+		{32, color.NRGBA{0xff, 0xee, 0x00, 0xc0}},
+		{37, color.NRGBA{0xff, 0x99, 0x00, 0xc0}},
+		{42, color.NRGBA{0xee, 0x00, 0x00, 0xc0}},
+		{50, color.NRGBA{0x99, 0x00, 0xcc, 0xc0}},
+	}
+
+	for _, tst := range testData {
+		img, err := SlopeElevation(planeWindow(size, 10, tst.slope), size, size, 1, 10, ramps["avalanche"])
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, size-2, size-2), img.Bounds())
+		assert.Equal(t, tst.col, img.At(2, 2), "slope %v", tst.slope)
+	}
+
+	img, err := SlopeElevation(planeWindow(size, 10, 0), size, size, 1, 10, ramps["gradient"])
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBA{0xff, 0xff, 0xff, 0xff}, img.At(0, 0))
+
+	_, err = SlopeElevation(planeWindow(size, 10, 0), size, size, 0, 10, ramps["gradient"])
+	assert.Error(t, err)
+}
+
+func Test_slopeHandler_1(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	for _, query := range []string{"", "?ramp=avalanche", "?ramp=gradient"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slope/14/11583/6049.png"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+
+		img, err := png.Decode(rec.Body)
+		require.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, TileSize, TileSize), img.Bounds())
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slope/14/11583/6049.png?ramp=unknown", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func Test_newSlopeRamps_config(t *testing.T) {
+	const size = 8
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "steep.txt")
+	require.NoError(t, os.WriteFile(file, []byte("0 0 0 0 0\n25 0 0 255\n"), 0644))
+
+	ramps, err := loadColorRamps(map[string]colorRampConfig{
+		"steep":     {file: file, mode: "discrete"},
+		"avalanche": {file: file},
+	})
+	require.NoError(t, err)
+	slopeRamps, err := newSlopeRamps(ramps)
+	require.NoError(t, err)
+
+	// configured ramps are added to presets and override them
+	require.Contains(t, slopeRamps, "gradient")
+	for _, name := range []string{"steep", "avalanche"} {
+		img, err := SlopeElevation(planeWindow(size, 10, 30), size, size, 1, 10, slopeRamps[name])
+		require.NoError(t, err)
+		assert.Equal(t, color.NRGBA{0x00, 0x00, 0xff, 0xff}, img.At(2, 2), name)
+	}
+	img, err := SlopeElevation(planeWindow(size, 10, 20), size, size, 1, 10, slopeRamps["steep"])
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBA{}, img.At(2, 2))
+
+	h := newTestTerra(t)
+	h.slopeRamps = slopeRamps
+	h.defaultSlopeRamp = "steep"
+	r := newRouter(h)
+
+	bodies := make(map[string]string)
+	for _, query := range []string{"", "?ramp=steep", "?ramp=gradient"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slope/14/11583/6049.png"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		bodies[query] = rec.Body.String()
+	}
+	assert.Equal(t, bodies["?ramp=steep"], bodies[""])
+	assert.NotEqual(t, bodies["?ramp=gradient"], bodies[""])
+
+	ramps["steep"] = colorRamp{cards: ramps["steep"].cards, units: UnitsFeet}
+	_, err = newSlopeRamps(ramps)
+	assert.Error(t, err)
+}
+
+func Test_AspectElevation_1(t *testing.T) {
+	const size = 8
+
+	// plane rising towards east faces west
+	img, err := AspectElevation(planeWindow(size, 10, 20), size, size, 1, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBAModel.Convert(aspectToColor(math.Pi)), img.At(2, 2))
+
+	// plane rising towards north faces south
+	north := make([]float64, size*size)
+	for idx := range north {
+		north[idx] = float64(size-idx/size) * 5
+	}
+	img, err = AspectElevation(north, size, size, 1, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBAModel.Convert(aspectToColor(3*math.Pi/2)), img.At(2, 2))
+
+	// gentle slope below threshold and flat area are masked
+	img, err = AspectElevation(planeWindow(size, 10, 3), size, size, 1, 10, 5)
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBA{}, img.At(2, 2))
+
+	img, err = AspectElevation(planeWindow(size, 10, 0), size, size, 1, 10, 0)
+	require.NoError(t, err)
+	assert.Equal(t, color.NRGBA{}, img.At(2, 2))
+
+	// compass hues
+	n, _ := colorful.MakeColor(aspectToColor(math.Pi / 2))
+	hue, _, _ := n.Hsv()
+	assert.InDelta(t, 0.0, hue, 0.5)
+	wst, _ := colorful.MakeColor(aspectToColor(math.Pi))
+	hue, _, _ = wst.Hsv()
+	assert.InDelta(t, 270.0, hue, 0.5)
+}
+
+func Test_aspectHandler_1(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/aspect/14/11583/6049.png?min_slope=2.5", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+
+	for _, query := range []string{"?min_slope=-1", "?min_slope=91", "?min_slope=flat"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/aspect/14/11583/6049.png"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+// valueRamp encodes values into 24-bit RGB, 0.001 per level around 1<<23
+type valueRamp struct{}
+
+func (valueRamp) ValueToColor(v float64) color.Color {
+	iv := uint32(math.Round(1<<23 + v*1000))
+	return color.NRGBA{uint8(iv >> 16), uint8(iv >> 8), uint8(iv), 0xff}
+}
+
+func valueAt(img image.Image, x int, y int) float64 {
+	c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	iv := uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+	return (float64(iv) - 1<<23) / 1000
+}
+
+func Test_TRIElevation_TPIElevation(t *testing.T) {
+	const size = 12
+	const border = 3
+
+	peak := make([]float64, size*size)
+	for idx := range peak {
+		peak[idx] = 100
+	}
+	peak[6*size+6] = 110
+
+	tri, err := TRIElevation(peak, size, size, border, 1, valueRamp{})
+	require.NoError(t, err)
+	tpi, err := TPIElevation(peak, size, size, border, 1, valueRamp{})
+	require.NoError(t, err)
+
+	// peak at window 6,6 is image 3,3
+	assert.InDelta(t, math.Sqrt(8*100.0), valueAt(tri, 3, 3), 0.01)
+	assert.InDelta(t, 10.0, valueAt(tpi, 3, 3), 0.01)
+	assert.InDelta(t, 10.0, valueAt(tri, 4, 3), 0.01)
+	assert.InDelta(t, -10.0/8, valueAt(tpi, 4, 3), 0.01)
+	assert.InDelta(t, 0.0, valueAt(tri, 0, 0), 0.01)
+	assert.InDelta(t, 0.0, valueAt(tpi, 0, 0), 0.01)
+
+	// summed area table matches direct computation
+	data := make([]float64, size*size)
+	for idx := range data {
+		data[idx] = 1000 + 50*math.Sin(float64(idx)*0.7) + float64(idx%size)
+	}
+	const radius = 3
+	tri, err = TRIElevation(data, size, size, border, radius, valueRamp{})
+	require.NoError(t, err)
+	tpi, err = TPIElevation(data, size, size, border, radius, valueRamp{})
+	require.NoError(t, err)
+
+	for y := 0; y < size-2*border; y++ {
+		for x := 0; x < size-2*border; x++ {
+			h := data[(y+border)*size+x+border]
+			sum, sumSq, n := 0.0, 0.0, 0.0
+			for dy := -radius; dy <= radius; dy++ {
+				for dx := -radius; dx <= radius; dx++ {
+					if dx == 0 && dy == 0 {
+						continue
+					}
+					v := data[(y+border+dy)*size+x+border+dx]
+					sum += v
+					sumSq += (v - h) * (v - h)
+					n++
+				}
+			}
+			require.InDelta(t, math.Sqrt(sumSq), valueAt(tri, x, y), 0.01)
+			require.InDelta(t, h-sum/n, valueAt(tpi, x, y), 0.01)
+		}
+	}
+
+	_, err = TRIElevation(data, size, size, border, border+1, valueRamp{})
+	assert.Error(t, err)
+}
+
+func Test_TRIElevation_TPIElevation_highFlat(t *testing.T) {
+	// tile sized window of flat terrain at high elevation
+	const size = 256 + 2*3
+	const border = 3
+
+	flat := make([]float64, size*size)
+	for idx := range flat {
+		flat[idx] = 4000.37
+	}
+
+	tri, err := TRIElevation(flat, size, size, border, border, valueRamp{})
+	require.NoError(t, err)
+	tpi, err := TPIElevation(flat, size, size, border, border, valueRamp{})
+	require.NoError(t, err)
+
+	for y := 0; y < size-2*border; y++ {
+		for x := 0; x < size-2*border; x++ {
+			require.InDelta(t, 0.0, valueAt(tri, x, y), 0.001, "tri %d,%d", x, y)
+			require.InDelta(t, 0.0, valueAt(tpi, x, y), 0.001, "tpi %d,%d", x, y)
+		}
+	}
+}
+
+func Test_triHandler_tpiHandler(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	for _, url := range []string{"/tri/14/11583/6049.png", "/tpi/14/11583/6049.png?radius=5"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		require.Equal(t, http.StatusOK, rec.Code, url)
+
+		img, err := png.Decode(rec.Body)
+		require.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, TileSize, TileSize), img.Bounds())
+	}
+
+	for _, query := range []string{"?radius=0", "?radius=257", "?radius=wide"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/tri/14/11583/6049.png"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func Test_CurvatureElevation_1(t *testing.T) {
+	const size = 9
+	const res = 10.0
+	const a = 0.01
+
+	surface := func(f func(x float64, y float64) float64) []float64 {
+		data := make([]float64, size*size)
+		for idx := range data {
+			x := float64(idx%size-size/2) * res
+			y := float64(size/2-idx/size) * res
+			data[idx] = f(x, y)
+		}
+		return data
+	}
+
+	dome := surface(func(x float64, y float64) float64 { return 1000 - a*(x*x+y*y) })
+	saddle := surface(func(x float64, y float64) float64 { return 1000 + a*(x*x-y*y) })
+
+	testData := []struct {
+		elevData []float64
+		kind     CurvatureKind
+		expected float64
+	}{
+		{dome, CurvatureProfile, 2 * a},
+		{dome, CurvaturePlan, 2 * a},
+		// on x axis saddle is concave downslope and convex across slope
+		{saddle, CurvatureProfile, -2 * a},
+		{saddle, CurvaturePlan, 2 * a},
+	}
+
+	for _, tst := range testData {
+		data, width, height, err := CurvatureElevation(tst.elevData, size, size, 1, res, tst.kind)
+		require.NoError(t, err)
+		require.Equal(t, size-2, width)
+		require.Equal(t, size-2, height)
+
+		// window pixel 6,4 is x = 20m, y = 0
+		assert.InDelta(t, tst.expected, data[3*width+5], epsilon, tst.kind)
+	}
+
+	// flat surface
+	data, _, _, err := CurvatureElevation(surface(func(x float64, y float64) float64 { return 5 }), size, size, 1, res, CurvaturePlan)
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, data[0])
+
+	_, _, _, err = CurvatureElevation(dome, size, size, 1, res, "mean")
+	assert.Error(t, err)
+}
+
+func Test_curvatureHandler_1(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/curvature/profile/14/11583/6049.png", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/curvature/plan/14/11583/6049.bin", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/octet-stream", rec.Header().Get("Content-Type"))
+	require.Equal(t, 4*TileSize*TileSize, rec.Body.Len())
+
+	elevData, winWidth, winHeight, err := h.getElevationWindow(context.Background(), 14, 11583, 6049, 1)
+	require.NoError(t, err)
+	pixel_res, err := slippymath.TilePixelResolution(14, 11583, 6049)
+	require.NoError(t, err)
+	expected, _, _, err := CurvatureElevation(elevData, winWidth, winHeight, 1, pixel_res, CurvaturePlan)
+	require.NoError(t, err)
+
+	raw := rec.Body.Bytes()
+	for _, idx := range []int{0, 1000, TileSize*TileSize - 1} {
+		v := math.Float32frombits(binary.LittleEndian.Uint32(raw[idx*4:]))
+		assert.InDelta(t, expected[idx], float64(v), 1e-6)
+	}
+
+	for _, url := range []string{"/curvature/mean/14/11583/6049.png", "/curvature/plan/14/11583/6049.tif"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, url)
+	}
+}
+
+func Test_ShadedReliefImage_1(t *testing.T) {
+	tint := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	tint.SetNRGBA(0, 0, color.NRGBA{200, 100, 50, 255})
+	tint.SetNRGBA(1, 0, color.NRGBA{200, 100, 50, 0})
+	shade := image.NewGray(image.Rect(0, 0, 2, 1))
+	shade.SetGray(0, 0, color.Gray{128})
+	shade.SetGray(1, 0, color.Gray{128})
+
+	testData := []struct {
+		mode    BlendMode
+		opacity float64
+		col     color.NRGBA
+	}{
+		{BlendMultiply, 1, color.NRGBA{100, 50, 25, 255}},
+		{BlendMultiply, 0.5, color.NRGBA{150, 75, 38, 255}},
+		{BlendMultiply, 0, color.NRGBA{200, 100, 50, 255}},
+		{BlendOverlay, 1, color.NRGBA{200, 100, 50, 255}},
+		{BlendSoftLight, 1, color.NRGBA{200, 100, 50, 255}},
+	}
+
+	for _, tst := range testData {
+		img, err := ShadedReliefImage(tint, shade, tst.mode, tst.opacity)
+		require.NoError(t, err)
+		assert.Equal(t, tst.col, img.At(0, 0), "%s %v", tst.mode, tst.opacity)
+		// transparent tint stays transparent
+		_, _, _, a := img.At(1, 0).RGBA()
+		assert.Equal(t, uint32(0), a)
+	}
+
+	_, err := ShadedReliefImage(tint, image.NewGray(image.Rect(0, 0, 1, 1)), BlendMultiply, 1)
+	assert.Error(t, err)
+}
+
+func Test_shadedReliefHandler_1(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	get := func(url string) image.Image {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		require.Equal(t, http.StatusOK, rec.Code, url)
+		img, err := png.Decode(rec.Body)
+		require.NoError(t, err)
+		return img
+	}
+
+	tint := get("/color-relief/14/11583/6049.img")
+	unshaded := get("/shaded-relief/14/11583/6049.img?opacity=0")
+	require.Equal(t, tint.Bounds(), unshaded.Bounds())
+	for _, p := range []image.Point{{0, 0}, {100, 37}, {TileSize - 1, TileSize - 1}} {
+		assert.Equal(t, color.NRGBAModel.Convert(tint.At(p.X, p.Y)), color.NRGBAModel.Convert(unshaded.At(p.X, p.Y)), p)
+	}
+
+	for _, query := range []string{"", "?blend=overlay&opacity=0.6", "?blend=soft-light&shading=multidirectional&ramp=default"} {
+		img := get("/shaded-relief/14/11583/6049.img" + query)
+		assert.Equal(t, image.Rect(0, 0, TileSize, TileSize), img.Bounds(), query)
+	}
+
+	// multiply by shade s and by inverted shade 1-s add up to the tint
+	gray := get("/shaded-relief/14/11583/6049.img?mode=gray")
+	inverted := get("/shaded-relief/14/11583/6049.img?mode=inverted")
+	for _, p := range []image.Point{{0, 0}, {100, 37}, {TileSize - 1, TileSize - 1}} {
+		tc := color.NRGBAModel.Convert(tint.At(p.X, p.Y)).(color.NRGBA)
+		gc := color.NRGBAModel.Convert(gray.At(p.X, p.Y)).(color.NRGBA)
+		ic := color.NRGBAModel.Convert(inverted.At(p.X, p.Y)).(color.NRGBA)
+		assert.InDelta(t, float64(tc.R), float64(gc.R)+float64(ic.R), 1, p)
+		assert.InDelta(t, float64(tc.G), float64(gc.G)+float64(ic.G), 1, p)
+		assert.InDelta(t, float64(tc.B), float64(gc.B)+float64(ic.B), 1, p)
+	}
+
+	for _, query := range []string{"?blend=screen", "?opacity=2", "?opacity=NaN", "?ramp=unknown", "?azimuth=400", "?mode=transparent", "?transp=1", "?mode=sepia"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/shaded-relief/14/11583/6049.img"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"sync"
+)
+
+// loadTiles fetches tiles of zoom level concurrently with at most
+// MaxConcurrency requests in flight, first error cancels remaining requests
+func (h *terra) loadTiles(ctx context.Context,
+	zoom int,
+	tiles []image.Point,
+	load func(ctx context.Context, zoom int, tile_X int, tile_Y int) error) error {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	sem := make(chan bool, MaxConcurrency)
+
+	for _, tile := range tiles {
+		select {
+		case sem <- true:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		tile := tile
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := load(ctx, zoom, tile.X, tile.Y)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// getTiles fetches source tiles concurrently, results are in order of tiles
+func (h *terra) getTiles(ctx context.Context, zoom int, tiles []image.Point) ([]*bytes.Buffer, error) {
+	out := make([]*bytes.Buffer, len(tiles))
+	idx := make(map[image.Point]int, len(tiles))
+	for i, tile := range tiles {
+		idx[tile] = i
+	}
+
+	err := h.loadTiles(ctx, zoom, tiles, func(ctx context.Context, zoom int, tile_X int, tile_Y int) error {
+		buf, err := h.getTile(ctx, zoom, tile_X, tile_Y)
+		if err != nil {
+			return err
+		}
+		out[idx[image.Point{tile_X, tile_Y}]] = buf
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// getElevationWindow returns row-major elevation grid of the tile extended
+// by border pixels on each side, taken from neighbouring tiles loaded
+// concurrently. Window wraps around antimeridian and is clamped at poles.
+func (h *terra) getElevationWindow(ctx context.Context,
+	zoom int,
+	tile_X int,
+	tile_Y int,
+	border int) ([]float64, int, int, error) {
+
+	if border < 0 || border > TileSize {
+		return nil, 0, 0, fmt.Errorf("invalid elevation window border: %d", border)
+	}
+
+	numTiles := 1 << uint(zoom)
+	worldSize := numTiles * TileSize
+
+	width := TileSize + 2*border
+	height := TileSize + 2*border
+
+	// global pixel coordinates of window columns and rows
+	cols := make([]int, width)
+	for i := range cols {
+		px := tile_X*TileSize - border + i
+		cols[i] = ((px % worldSize) + worldSize) % worldSize
+	}
+	rows := make([]int, height)
+	for i := range rows {
+		py := tile_Y*TileSize - border + i
+		if py < 0 {
+			py = 0
+		}
+		if py >= worldSize {
+			py = worldSize - 1
+		}
+		rows[i] = py
+	}
+
+	var tiles []image.Point
+	for _, ty := range distinctTiles(rows) {
+		for _, tx := range distinctTiles(cols) {
+			tiles = append(tiles, image.Point{tx, ty})
+		}
+	}
+
+	var lock sync.Mutex
+	elevTiles := make(map[image.Point][]float32, len(tiles))
+
+	err := h.loadTiles(ctx, zoom, tiles, func(ctx context.Context, zoom int, tile_X int, tile_Y int) error {
+		elevTile, err := h.getElevationTile(ctx, zoom, tile_X, tile_Y)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		elevTiles[image.Point{tile_X, tile_Y}] = elevTile
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	data := make([]float64, width*height)
+
+	idx := 0
+	for _, py := range rows {
+		for _, px := range cols {
+			elevTile := elevTiles[image.Point{px / TileSize, py / TileSize}]
+			data[idx] = float64(elevTile[(py%TileSize)*TileSize+px%TileSize])
+			idx++
+		}
+	}
+
+	return data, width, height, nil
+}
+
+// distinctTiles returns tile indexes of pixel coordinates in order of appearance
+func distinctTiles(pixels []int) []int {
+	var out []int
+	seen := make(map[int]bool)
+	for _, p := range pixels {
+		t := p / TileSize
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flatTileStore serves terrarium tiles of constant height 100*x + y
+type flatTileStore struct{}
+
+func (flatTileStore) ClearTile(ctx context.Context, z uint32, x uint32, y uint32) {
+}
+
+func (flatTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32) ([]byte, error) {
+	if x >= 1<<z || y >= 1<<z {
+		return nil, errors.New("tile out of range")
+	}
+
+	data := make([]float64, TileSize*TileSize)
+	for idx := range data {
+		data[idx] = float64(100*x + y)
+	}
+	img, err := terrariumEncoding{}.EncodeElevation(data, TileSize, TileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	err = png.Encode(buf, img)
+	return buf.Bytes(), err
+}
+
+func Test_getElevationWindow_1(t *testing.T) {
+	h := newTestTerra(t)
+	ctx := context.Background()
+
+	const border = 3
+	data, width, height, err := h.getElevationWindow(ctx, 14, 11583, 6049, border)
+	require.NoError(t, err)
+	require.Equal(t, TileSize+2*border, width)
+	require.Equal(t, TileSize+2*border, height)
+
+	center, err := h.getElevationTile(ctx, 14, 11583, 6049)
+	require.NoError(t, err)
+	upLeft, err := h.getElevationTile(ctx, 14, 11582, 6048)
+	require.NoError(t, err)
+	lowRight, err := h.getElevationTile(ctx, 14, 11584, 6050)
+	require.NoError(t, err)
+
+	assert.Equal(t, float64(center[0]), data[border*width+border])
+	assert.Equal(t, float64(center[TileSize*TileSize-1]), data[(height-border-1)*width+width-border-1])
+	assert.Equal(t, float64(upLeft[(TileSize-border)*TileSize+TileSize-border]), data[0])
+	assert.Equal(t, float64(lowRight[(border-1)*TileSize+border-1]), data[width*height-1])
+
+	// missing neighbour tile
+	_, _, _, err = h.getElevationWindow(ctx, 14, 11585, 6051, border)
+	assert.Error(t, err)
+}
+
+func Test_getElevationWindowUnits(t *testing.T) {
+	h := newTestTerra(t)
+	ctx := context.Background()
+
+	meters, _, _, err := h.getElevationWindowUnits(ctx, UnitsMeters, 14, 11583, 6049, 1)
+	require.NoError(t, err)
+	feet, width, height, err := h.getElevationWindowUnits(ctx, UnitsFeet, 14, 11583, 6049, 1)
+	require.NoError(t, err)
+	require.Len(t, feet, width*height)
+
+	for idx := range meters {
+		require.InDelta(t, meters[idx]/metersPerFoot, feet[idx], 1e-9)
+	}
+
+	_, _, _, err = h.getElevationWindowUnits(ctx, UnitsFeet, 14, 11585, 6051, 1)
+	assert.Error(t, err)
+}
+
+func Test_getElevationWindow_wrap(t *testing.T) {
+	h, err := NewTerra(flatTileStore{}, terrariumEncoding{}, defaultTileCacheSize, defaultElevationCacheSize)
+	require.NoError(t, err)
+
+	const border = 2
+	data, width, height, err := h.getElevationWindow(context.Background(), 1, 0, 0, border)
+	require.NoError(t, err)
+
+	// west of antimeridian is tile 1/1/0
+	assert.Equal(t, 100.0, data[border*width])
+	// north of pole is clamped to the tile itself
+	assert.Equal(t, 0.0, data[border])
+	// south neighbour
+	assert.Equal(t, 1.0, data[(height-1)*width+border])
+	// south-east neighbour
+	assert.Equal(t, 101.0, data[width*height-1])
+
+	// single tile world
+	data, _, _, err = h.getElevationWindow(context.Background(), 0, 0, 0, border)
+	require.NoError(t, err)
+	for _, v := range data {
+		require.Equal(t, 0.0, v)
+	}
+}
+
+func Test_getTiles_1(t *testing.T) {
+	h := newTestTerra(t)
+
+	tiles := []image.Point{{11583, 6049}, {11584, 6050}, {11582, 6048}}
+	bufs, err := h.getTiles(context.Background(), 14, tiles)
+	require.NoError(t, err)
+	require.Len(t, bufs, len(tiles))
+
+	for idx, tile := range tiles {
+		buf, err := h.getTile(context.Background(), 14, tile.X, tile.Y)
+		require.NoError(t, err)
+		assert.Equal(t, buf.Bytes(), bufs[idx].Bytes())
+	}
+
+	_, err = h.getTiles(context.Background(), 14, []image.Point{{11583, 6049}, {1, 1}})
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = h.getTiles(ctx, 14, []image.Point{{11583, 6050}})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_tilesContoursHandler_1(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/contours/14/11583/6049.geojson?interval=10", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "elevation")
+}
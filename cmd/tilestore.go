@@ -2,13 +2,14 @@ package cmd
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	lrucache "github.com/hashicorp/golang-lru"
 )
 
 var (
@@ -20,19 +21,29 @@ type TileStore interface {
 	ClearTile(ctx context.Context, z uint32, x uint32, y uint32)
 }
 
+// TileWriter is an output target for rendered tiles
+type TileWriter interface {
+	PutTile(ctx context.Context, z uint32, x uint32, y uint32, data []byte) error
+	SetMetadata(ctx context.Context, name string, value string) error
+	Close() error
+}
+
 type S3TileStore struct {
 	s3Client      *s3.Client
 	bucketName    string
 	tileNameTempl string
 }
 
+// CacheTileStore is in-memory LRU cache of source tiles bounded by total size
 type CacheTileStore struct {
-	tileCache     *lrucache.Cache
+	tileCache     *byteLRU
 	tileNameTempl string
 }
 
+// ElevationTileStore is in-memory LRU cache of decoded elevation data
+// bounded by total size, heights are kept as float32 to halve memory use
 type ElevationTileStore struct {
-	tileCache     *lrucache.Cache
+	tileCache     *byteLRU
 	tileNameTempl string
 }
 
@@ -69,8 +80,8 @@ func (ts *S3TileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32
 	return data.Bytes(), nil
 }
 
-func NewCacheTileStore(tileNameTempl string, cacheSize int) (*CacheTileStore, error) {
-	tileCache, err := lrucache.New(cacheSize)
+func NewCacheTileStore(tileNameTempl string, maxBytes int64) (*CacheTileStore, error) {
+	tileCache, err := newByteLRU(maxBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -89,13 +100,10 @@ func (ts *CacheTileStore) ClearTile(ctx context.Context, z uint32, x uint32, y u
 
 func (ts *CacheTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32) ([]byte, error) {
 	oName := fmt.Sprintf(ts.tileNameTempl, z, x, y)
-	if !ts.tileCache.Contains(oName) {
-		return nil, ErrTileNotFound
-	}
 
 	obj, ok := ts.tileCache.Get(oName)
 	if !ok {
-		return nil, errors.New("cache error")
+		return nil, ErrTileNotFound
 	}
 
 	cacheData, ok := obj.([]byte)
@@ -108,11 +116,15 @@ func (ts *CacheTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uin
 
 func (ts *CacheTileStore) Add(z uint32, x uint32, y uint32, data []byte) {
 	key := fmt.Sprintf(ts.tileNameTempl, z, x, y)
-	ts.tileCache.Add(key, data)
+	ts.tileCache.Add(key, data, int64(len(data)))
 }
 
-func NewElevationTileStore(tileNameTempl string, cacheSize int) (*ElevationTileStore, error) {
-	tileCache, err := lrucache.New(cacheSize)
+func (ts *CacheTileStore) Stats() CacheStats {
+	return ts.tileCache.Stats()
+}
+
+func NewElevationTileStore(tileNameTempl string, maxBytes int64) (*ElevationTileStore, error) {
+	tileCache, err := newByteLRU(maxBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -123,18 +135,16 @@ func NewElevationTileStore(tileNameTempl string, cacheSize int) (*ElevationTileS
 	return &ts, nil
 }
 
-func (ts *ElevationTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32) ([]float64, error) {
+// GetTile returns cached heights, shared by all readers and must not be modified
+func (ts *ElevationTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32) ([]float32, error) {
 	oName := fmt.Sprintf(ts.tileNameTempl, z, x, y)
-	if !ts.tileCache.Contains(oName) {
-		return nil, ErrTileNotFound
-	}
 
 	obj, ok := ts.tileCache.Get(oName)
 	if !ok {
-		return nil, errors.New("cache error")
+		return nil, ErrTileNotFound
 	}
 
-	cacheData, ok := obj.([]float64)
+	cacheData, ok := obj.([]float32)
 	if !ok {
 		return nil, errors.New("cache error")
 	}
@@ -142,7 +152,106 @@ func (ts *ElevationTileStore) GetTile(ctx context.Context, z uint32, x uint32, y
 	return cacheData, nil
 }
 
-func (ts *ElevationTileStore) Add(z uint32, x uint32, y uint32, data []float64) {
+func (ts *ElevationTileStore) Add(z uint32, x uint32, y uint32, data []float32) {
 	key := fmt.Sprintf(ts.tileNameTempl, z, x, y)
-	ts.tileCache.Add(key, data)
+	ts.tileCache.Add(key, data, int64(len(data))*4)
+}
+
+func (ts *ElevationTileStore) Stats() CacheStats {
+	return ts.tileCache.Stats()
+}
+
+// byteLRU is LRU cache evicting least recently used entries
+// when total size of entries exceeds max size
+type byteLRU struct {
+	lock      sync.Mutex
+	maxBytes  int64
+	size      int64
+	ll        *list.List
+	items     map[string]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type byteLRUEntry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+func newByteLRU(maxBytes int64) (*byteLRU, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid cache size: %d", maxBytes)
+	}
+	c := byteLRU{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+	return &c, nil
+}
+
+func (c *byteLRU) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*byteLRUEntry).value, true
+}
+
+// Add inserts or replaces entry, entries larger than max size are not cached
+func (c *byteLRU) Add(key string, value interface{}, size int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+	if size > c.maxBytes {
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&byteLRUEntry{key: key, value: value, size: size})
+	c.size += size
+
+	for c.size > c.maxBytes {
+		c.removeElement(c.ll.Back())
+		c.evictions++
+	}
+}
+
+func (c *byteLRU) Remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *byteLRU) removeElement(el *list.Element) {
+	e := c.ll.Remove(el).(*byteLRUEntry)
+	delete(c.items, e.key)
+	c.size -= e.size
+}
+
+func (c *byteLRU) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.items),
+		Bytes:     c.size,
+		MaxBytes:  c.maxBytes,
+	}
 }
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DirTileStore serves tiles from a local directory tree laid out as
+// {z}/{x}/{y}.png, e.g. a pre-synced copy of the terrarium bucket.
+type DirTileStore struct {
+	rootDir       string
+	tileNameTempl string
+}
+
+func NewDirTileStore(rootDir string, tileNameTempl string) (*DirTileStore, error) {
+	fi, err := os.Stat(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", rootDir)
+	}
+
+	ts := DirTileStore{
+		rootDir:       rootDir,
+		tileNameTempl: tileNameTempl,
+	}
+	return &ts, nil
+}
+
+func (ts *DirTileStore) ClearTile(ctx context.Context, z uint32, x uint32, y uint32) {
+}
+
+func (ts *DirTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32) ([]byte, error) {
+	fName := filepath.Join(ts.rootDir, filepath.FromSlash(fmt.Sprintf(ts.tileNameTempl, z, x, y)))
+
+	data, err := os.ReadFile(fName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrTileNotFound
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
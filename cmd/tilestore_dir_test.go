@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_dirTileStore_1(t *testing.T) {
+	dat, err := os.ReadFile("./test_data/terrarium_14_11583_6049.png")
+	require.NoError(t, err)
+
+	rootDir := t.TempDir()
+	tileDir := filepath.Join(rootDir, "14", "11583")
+	require.NoError(t, os.MkdirAll(tileDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tileDir, "6049.png"), dat, 0644))
+
+	ts, err := NewDirTileStore(rootDir, "%d/%d/%d.png")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	tile, err := ts.GetTile(ctx, 14, 11583, 6049)
+	require.NoError(t, err)
+	assert.Equal(t, dat, tile)
+
+	_, err = ts.GetTile(ctx, 14, 11583, 6050)
+	assert.Equal(t, ErrTileNotFound, err)
+
+	_, err = NewDirTileStore(filepath.Join(rootDir, "missing"), "%d/%d/%d.png")
+	assert.Error(t, err)
+}
@@ -0,0 +1,434 @@
+package cmd
+
+import (
+	"container/heap"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskCacheIndexFile     = "index.json"
+	diskCacheTmpPrefix     = ".tmp-"
+	diskCacheFlushInterval = 30 * time.Second
+)
+
+// diskCacheNamespace returns cache subdirectory name of tiles
+// of given source and encoding
+func diskCacheNamespace(sourceID string, encoding string) string {
+	hash := sha256.Sum256([]byte(sourceID))
+	return fmt.Sprintf("%s-%x", encoding, hash[:8])
+}
+
+type EvictionPolicy string
+
+const (
+	EvictionLRU EvictionPolicy = "lru"
+	EvictionLFU EvictionPolicy = "lfu"
+)
+
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	MaxBytes  int64  `json:"max_bytes"`
+}
+
+type diskCacheEntry struct {
+	Key        string `json:"key"`
+	Size       int64  `json:"size"`
+	LastAccess int64  `json:"last_access"`
+	Hits       uint64 `json:"hits"`
+
+	heapIdx int
+}
+
+// diskCacheQueue orders entries by eviction priority
+type diskCacheQueue struct {
+	entries []*diskCacheEntry
+	policy  EvictionPolicy
+}
+
+func (q *diskCacheQueue) Len() int { return len(q.entries) }
+
+func (q *diskCacheQueue) Less(i, j int) bool {
+	a, b := q.entries[i], q.entries[j]
+	if q.policy == EvictionLFU && a.Hits != b.Hits {
+		return a.Hits < b.Hits
+	}
+	return a.LastAccess < b.LastAccess
+}
+
+func (q *diskCacheQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.entries[i].heapIdx = i
+	q.entries[j].heapIdx = j
+}
+
+func (q *diskCacheQueue) Push(x interface{}) {
+	e := x.(*diskCacheEntry)
+	e.heapIdx = len(q.entries)
+	q.entries = append(q.entries, e)
+}
+
+func (q *diskCacheQueue) Pop() interface{} {
+	n := len(q.entries)
+	e := q.entries[n-1]
+	q.entries[n-1] = nil
+	q.entries = q.entries[:n-1]
+	e.heapIdx = -1
+	return e
+}
+
+// DiskCacheTileStore is size-bounded persistent tiles cache.
+// Tiles are written atomically into {z}/{x}/{y}.png files, index with
+// access statistics is flushed periodically and rebuilt from cached files
+// on open, so cache stays consistent after crash.
+type DiskCacheTileStore struct {
+	rootDir       string
+	tileNameTempl string
+	maxBytes      int64
+
+	lock       sync.Mutex
+	entries    map[string]*diskCacheEntry
+	queue      *diskCacheQueue
+	totalBytes int64
+	hits       uint64
+	misses     uint64
+	evictions  uint64
+	dirty      bool
+	lastFlush  time.Time
+
+	flushLock sync.Mutex
+}
+
+func NewDiskCacheTileStore(rootDir string, maxBytes int64, policy EvictionPolicy) (*DiskCacheTileStore, error) {
+	switch policy {
+	case EvictionLRU, EvictionLFU:
+	default:
+		return nil, fmt.Errorf("unsupported cache eviction policy: %s", policy)
+	}
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("invalid disk cache size: %d", maxBytes)
+	}
+
+	err := os.MkdirAll(rootDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := DiskCacheTileStore{
+		rootDir:       rootDir,
+		tileNameTempl: "%d/%d/%d.png",
+		maxBytes:      maxBytes,
+		entries:       make(map[string]*diskCacheEntry),
+		queue:         &diskCacheQueue{policy: policy},
+		lastFlush:     time.Now(),
+	}
+
+	err = ts.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ts, nil
+}
+
+// loadIndex restores cache entries from index file and cached files,
+// files missing in index (e.g. written after last flush) are added
+// with their modification time as last access
+func (ts *DiskCacheTileStore) loadIndex() error {
+	indexed := make(map[string]diskCacheEntry)
+
+	data, err := os.ReadFile(filepath.Join(ts.rootDir, diskCacheIndexFile))
+	if err == nil {
+		var idxEntries []diskCacheEntry
+		if err := json.Unmarshal(data, &idxEntries); err != nil {
+			log.Printf("disk cache: ignore corrupted index: %v", err)
+		}
+		for _, e := range idxEntries {
+			indexed[e.Key] = e
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	err = filepath.WalkDir(ts.rootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(ts.rootDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == diskCacheIndexFile {
+			return nil
+		}
+		// leftover from interrupted write
+		if strings.HasPrefix(d.Name(), diskCacheTmpPrefix) {
+			return os.Remove(path)
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		e := diskCacheEntry{
+			Key:        key,
+			Size:       fi.Size(),
+			LastAccess: fi.ModTime().UnixNano(),
+		}
+		if ie, ok := indexed[key]; ok && ie.Size == fi.Size() {
+			e.LastAccess = ie.LastAccess
+			e.Hits = ie.Hits
+		}
+
+		ts.addEntry(&e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ts.evict(nil)
+	return nil
+}
+
+// addEntry registers new entry, must be called with lock held
+func (ts *DiskCacheTileStore) addEntry(e *diskCacheEntry) {
+	if old, ok := ts.entries[e.Key]; ok {
+		ts.removeEntry(old)
+	}
+	ts.entries[e.Key] = e
+	heap.Push(ts.queue, e)
+	ts.totalBytes += e.Size
+	ts.dirty = true
+}
+
+// removeEntry unregisters entry, must be called with lock held
+func (ts *DiskCacheTileStore) removeEntry(e *diskCacheEntry) {
+	delete(ts.entries, e.Key)
+	if e.heapIdx >= 0 {
+		heap.Remove(ts.queue, e.heapIdx)
+	}
+	ts.totalBytes -= e.Size
+	ts.dirty = true
+}
+
+// evict removes entries by eviction policy until cache fits into max size,
+// keep entry (if not nil) is not evicted, so just added tile is not
+// the first LFU victim. Must be called with lock held
+func (ts *DiskCacheTileStore) evict(keep *diskCacheEntry) {
+	if keep != nil && keep.heapIdx >= 0 {
+		heap.Remove(ts.queue, keep.heapIdx)
+		defer heap.Push(ts.queue, keep)
+	}
+
+	for ts.totalBytes > ts.maxBytes && ts.queue.Len() > 0 {
+		e := ts.queue.entries[0]
+		ts.removeEntry(e)
+		ts.evictions++
+
+		err := os.Remove(ts.tilePath(e.Key))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("disk cache: evict %s: %v", e.Key, err)
+		}
+	}
+}
+
+func (ts *DiskCacheTileStore) tileKey(z uint32, x uint32, y uint32) string {
+	return fmt.Sprintf(ts.tileNameTempl, z, x, y)
+}
+
+func (ts *DiskCacheTileStore) tilePath(key string) string {
+	return filepath.Join(ts.rootDir, filepath.FromSlash(key))
+}
+
+func (ts *DiskCacheTileStore) ClearTile(ctx context.Context, z uint32, x uint32, y uint32) {
+	key := ts.tileKey(z, x, y)
+
+	ts.lock.Lock()
+	if e, ok := ts.entries[key]; ok {
+		ts.removeEntry(e)
+	}
+	ts.lock.Unlock()
+
+	err := os.Remove(ts.tilePath(key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("disk cache: clear %s: %v", key, err)
+	}
+}
+
+func (ts *DiskCacheTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32) ([]byte, error) {
+	key := ts.tileKey(z, x, y)
+
+	ts.lock.Lock()
+	_, ok := ts.entries[key]
+	if !ok {
+		ts.misses++
+	}
+	ts.lock.Unlock()
+
+	if !ok {
+		return nil, ErrTileNotFound
+	}
+
+	data, err := os.ReadFile(ts.tilePath(key))
+	if err != nil {
+		ts.lock.Lock()
+		ts.misses++
+		if e, ok := ts.entries[key]; ok {
+			ts.removeEntry(e)
+		}
+		ts.lock.Unlock()
+
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrTileNotFound
+		}
+		return nil, err
+	}
+
+	ts.lock.Lock()
+	ts.hits++
+	if e, ok := ts.entries[key]; ok {
+		e.LastAccess = time.Now().UnixNano()
+		e.Hits++
+		heap.Fix(ts.queue, e.heapIdx)
+		ts.dirty = true
+	}
+	ts.lock.Unlock()
+
+	ts.flushIfDue()
+
+	return data, nil
+}
+
+// Add writes tile into cache, write errors are logged as cache is best effort
+func (ts *DiskCacheTileStore) Add(z uint32, x uint32, y uint32, data []byte) {
+	key := ts.tileKey(z, x, y)
+	if int64(len(data)) > ts.maxBytes {
+		return
+	}
+
+	fName := ts.tilePath(key)
+	err := writeFileAtomic(fName, data)
+	if err != nil {
+		log.Printf("disk cache: add %s: %v", key, err)
+		return
+	}
+
+	e := diskCacheEntry{
+		Key:        key,
+		Size:       int64(len(data)),
+		LastAccess: time.Now().UnixNano(),
+	}
+
+	ts.lock.Lock()
+	ts.addEntry(&e)
+	ts.evict(&e)
+	ts.lock.Unlock()
+
+	ts.flushIfDue()
+}
+
+func (ts *DiskCacheTileStore) Stats() CacheStats {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+
+	return CacheStats{
+		Hits:      ts.hits,
+		Misses:    ts.misses,
+		Evictions: ts.evictions,
+		Entries:   len(ts.entries),
+		Bytes:     ts.totalBytes,
+		MaxBytes:  ts.maxBytes,
+	}
+}
+
+func (ts *DiskCacheTileStore) flushIfDue() {
+	ts.lock.Lock()
+	due := ts.dirty && time.Since(ts.lastFlush) > diskCacheFlushInterval
+	ts.lock.Unlock()
+
+	if due {
+		if err := ts.Flush(); err != nil {
+			log.Printf("disk cache: flush index: %v", err)
+		}
+	}
+}
+
+// Flush writes cache index with access statistics
+func (ts *DiskCacheTileStore) Flush() error {
+	ts.flushLock.Lock()
+	defer ts.flushLock.Unlock()
+
+	ts.lock.Lock()
+	idxEntries := make([]diskCacheEntry, 0, len(ts.entries))
+	for _, e := range ts.entries {
+		idxEntries = append(idxEntries, *e)
+	}
+	ts.dirty = false
+	ts.lastFlush = time.Now()
+	ts.lock.Unlock()
+
+	data, err := json.Marshal(idxEntries)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(ts.rootDir, diskCacheIndexFile), data)
+}
+
+func (ts *DiskCacheTileStore) Close() error {
+	return ts.Flush()
+}
+
+// writeFileAtomic writes data into temporary file and renames it into place,
+// so readers never observe partially written file
+func writeFileAtomic(fName string, data []byte) error {
+	dir := filepath.Dir(fName)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, diskCacheTmpPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_diskCacheTileStore_lru(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := context.Background()
+
+	ts, err := NewDiskCacheTileStore(rootDir, 10, EvictionLRU)
+	require.NoError(t, err)
+
+	_, err = ts.GetTile(ctx, 1, 0, 0)
+	assert.Equal(t, ErrTileNotFound, err)
+
+	ts.Add(1, 0, 0, []byte("aaaa"))
+	time.Sleep(time.Millisecond)
+	ts.Add(1, 0, 1, []byte("bbbb"))
+	time.Sleep(time.Millisecond)
+
+	tile, err := ts.GetTile(ctx, 1, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaa", string(tile))
+	time.Sleep(time.Millisecond)
+
+	// least recently used 1/0/1 is evicted
+	ts.Add(1, 1, 0, []byte("cccc"))
+
+	_, err = ts.GetTile(ctx, 1, 0, 1)
+	assert.Equal(t, ErrTileNotFound, err)
+	assert.NoFileExists(t, filepath.Join(rootDir, "1", "0", "1.png"))
+	assert.FileExists(t, filepath.Join(rootDir, "1", "1", "0.png"))
+
+	stats := ts.Stats()
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 2, Evictions: 1, Entries: 2, Bytes: 8, MaxBytes: 10}, stats)
+
+	ts.ClearTile(ctx, 1, 1, 0)
+	_, err = ts.GetTile(ctx, 1, 1, 0)
+	assert.Equal(t, ErrTileNotFound, err)
+	assert.Equal(t, int64(4), ts.Stats().Bytes)
+
+	_, err = NewDiskCacheTileStore(rootDir, 10, "mru")
+	assert.Error(t, err)
+}
+
+func Test_diskCacheTileStore_lfu(t *testing.T) {
+	ctx := context.Background()
+
+	ts, err := NewDiskCacheTileStore(t.TempDir(), 10, EvictionLFU)
+	require.NoError(t, err)
+
+	ts.Add(1, 0, 1, []byte("bbbb"))
+	time.Sleep(time.Millisecond)
+	ts.Add(1, 0, 0, []byte("aaaa"))
+	for i := 0; i < 2; i++ {
+		_, err = ts.GetTile(ctx, 1, 0, 1)
+		require.NoError(t, err)
+	}
+	_, err = ts.GetTile(ctx, 1, 0, 0)
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+
+	// less frequently used 1/0/0 is evicted though accessed more recently
+	ts.Add(1, 1, 0, []byte("cccc"))
+
+	_, err = ts.GetTile(ctx, 1, 0, 1)
+	assert.NoError(t, err)
+	_, err = ts.GetTile(ctx, 1, 1, 0)
+	assert.NoError(t, err)
+	_, err = ts.GetTile(ctx, 1, 0, 0)
+	assert.Equal(t, ErrTileNotFound, err)
+}
+
+func Test_diskCacheTileStore_reopen(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := context.Background()
+
+	ts, err := NewDiskCacheTileStore(rootDir, 100, EvictionLFU)
+	require.NoError(t, err)
+
+	ts.Add(1, 0, 0, []byte("aaaa"))
+	ts.Add(1, 0, 1, []byte("bbbb"))
+	for i := 0; i < 3; i++ {
+		_, err = ts.GetTile(ctx, 1, 0, 1)
+		require.NoError(t, err)
+	}
+	require.NoError(t, ts.Close())
+
+	// tile written after index flush and interrupted write
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "2", "0"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "2", "0", "0.png"), []byte("cccc"), 0644))
+	tmpFile := filepath.Join(rootDir, "2", "0", diskCacheTmpPrefix+"123")
+	require.NoError(t, os.WriteFile(tmpFile, []byte("cc"), 0644))
+
+	ts, err = NewDiskCacheTileStore(rootDir, 100, EvictionLFU)
+	require.NoError(t, err)
+	assert.NoFileExists(t, tmpFile)
+
+	stats := ts.Stats()
+	assert.Equal(t, 3, stats.Entries)
+	assert.Equal(t, int64(12), stats.Bytes)
+
+	tile, err := ts.GetTile(ctx, 2, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "cccc", string(tile))
+
+	// access statistics are restored from index
+	assert.Equal(t, uint64(3), ts.entries["1/0/1.png"].Hits)
+
+	// reopen with smaller size evicts least frequently used tile
+	require.NoError(t, ts.Close())
+	ts, err = NewDiskCacheTileStore(rootDir, 8, EvictionLFU)
+	require.NoError(t, err)
+
+	_, err = ts.GetTile(ctx, 1, 0, 0)
+	assert.Equal(t, ErrTileNotFound, err)
+	_, err = ts.GetTile(ctx, 1, 0, 1)
+	assert.NoError(t, err)
+}
+
+func Test_diskCacheNamespace(t *testing.T) {
+	rootDir := t.TempDir()
+	ctx := context.Background()
+
+	open := func(sourceID string, encoding string) *DiskCacheTileStore {
+		ts, err := NewDiskCacheTileStore(
+			filepath.Join(rootDir, diskCacheNamespace(sourceID, encoding)), 100, EvictionLRU)
+		require.NoError(t, err)
+		return ts
+	}
+
+	ts := open("dir|/data/terrarium", "terrarium")
+	ts.Add(1, 0, 0, []byte("aaaa"))
+	require.NoError(t, ts.Close())
+
+	// same cache dir reopened with another source or encoding
+	for _, cfg := range [][2]string{
+		{"dir|/data/mapbox", "terrarium"},
+		{"dir|/data/terrarium", "mapbox"},
+	} {
+		ts = open(cfg[0], cfg[1])
+		_, err := ts.GetTile(ctx, 1, 0, 0)
+		assert.Equal(t, ErrTileNotFound, err, cfg)
+	}
+
+	ts = open("dir|/data/terrarium", "terrarium")
+	tile, err := ts.GetTile(ctx, 1, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "aaaa", string(tile))
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHTTPTimeout    = 10 * time.Second
+	defaultHTTPRetries    = 3
+	defaultHTTPRetryDelay = 200 * time.Millisecond
+)
+
+// HTTPTileStore fetches tiles from XYZ tile server.
+// URL template placeholders: {z}, {x}, {y}, {-y} (TMS row) and {apikey}.
+type HTTPTileStore struct {
+	client     *http.Client
+	urlTempl   string
+	apiKey     string
+	headers    map[string]string
+	timeout    time.Duration
+	maxRetries int
+	retryDelay time.Duration
+}
+
+func NewHTTPTileStore(urlTempl string,
+	apiKey string,
+	headers map[string]string,
+	timeout time.Duration,
+	maxRetries int) (*HTTPTileStore, error) {
+
+	for _, p := range []string{"{z}", "{x}"} {
+		if !strings.Contains(urlTempl, p) {
+			return nil, fmt.Errorf("invalid tile URL template, missing %s: %s", p, urlTempl)
+		}
+	}
+	if !strings.Contains(urlTempl, "{y}") && !strings.Contains(urlTempl, "{-y}") {
+		return nil, fmt.Errorf("invalid tile URL template, missing {y}: %s", urlTempl)
+	}
+	if strings.Contains(urlTempl, "{apikey}") && apiKey == "" {
+		return nil, errors.New("tile URL template requires API key")
+	}
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+
+	ts := HTTPTileStore{
+		client:     &http.Client{},
+		urlTempl:   urlTempl,
+		apiKey:     apiKey,
+		headers:    headers,
+		timeout:    timeout,
+		maxRetries: maxRetries,
+		retryDelay: defaultHTTPRetryDelay,
+	}
+	return &ts, nil
+}
+
+func (ts *HTTPTileStore) ClearTile(ctx context.Context, z uint32, x uint32, y uint32) {
+}
+
+func (ts *HTTPTileStore) tileURL(z uint32, x uint32, y uint32) string {
+	r := strings.NewReplacer(
+		"{z}", strconv.FormatUint(uint64(z), 10),
+		"{x}", strconv.FormatUint(uint64(x), 10),
+		"{y}", strconv.FormatUint(uint64(y), 10),
+		"{-y}", strconv.FormatUint(uint64(tmsTileRow(z, y)), 10),
+		"{apikey}", ts.apiKey,
+	)
+	return r.Replace(ts.urlTempl)
+}
+
+func (ts *HTTPTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32) ([]byte, error) {
+	url := ts.tileURL(z, x, y)
+	key := fmt.Sprintf(tileKeyTempl, z, x, y)
+
+	var err error
+	for attempt := 0; attempt <= ts.maxRetries; attempt++ {
+		if attempt > 0 {
+			// exponential backoff
+			delay := ts.retryDelay << (attempt - 1)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+
+		var data []byte
+		var retry bool
+		data, retry, err = ts.fetch(ctx, url, key)
+		if err == nil {
+			return data, nil
+		}
+		if !retry || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	return nil, err
+}
+
+// fetch requests tile once, returns whether failed request can be retried.
+// Errors refer to tile key rather than URL which may contain API key.
+func (ts *HTTPTileStore) fetch(ctx context.Context, url string, key string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, ts.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	for k, v := range ts.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := ts.client.Do(req)
+	if err != nil {
+		var urlErr *neturl.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, true, fmt.Errorf("GET tile %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, true, err
+		}
+		return data, false, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, ErrTileNotFound
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("GET tile %s: %s", key, resp.Status)
+	default:
+		return nil, false, fmt.Errorf("GET tile %s: %s", key, resp.Status)
+	}
+}
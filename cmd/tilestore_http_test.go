@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_httpTileStore_1(t *testing.T) {
+	var failures int32 = 2
+	var requests int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		if r.Header.Get("X-Client") != "surfacemap" || r.URL.Query().Get("key") != "secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/14/11583/6049.png":
+			w.Write([]byte("tile"))
+		case "/14/11583/6050.png":
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("retried"))
+		case "/14/11583/6051.png":
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("slow"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	ts, err := NewHTTPTileStore(srv.URL+"/{z}/{x}/{y}.png?key={apikey}",
+		"secret", map[string]string{"X-Client": "surfacemap"}, 50*time.Millisecond, 2)
+	require.NoError(t, err)
+	ts.retryDelay = time.Millisecond
+
+	ctx := context.Background()
+
+	tile, err := ts.GetTile(ctx, 14, 11583, 6049)
+	require.NoError(t, err)
+	assert.Equal(t, "tile", string(tile))
+
+	atomic.StoreInt32(&requests, 0)
+	tile, err = ts.GetTile(ctx, 14, 11583, 6050)
+	require.NoError(t, err)
+	assert.Equal(t, "retried", string(tile))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = ts.GetTile(ctx, 14, 11583, 6052)
+	assert.Equal(t, ErrTileNotFound, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// request timeout
+	_, err = ts.GetTile(ctx, 14, 11583, 6051)
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret")
+
+	// cancelled request context
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ts.GetTile(cctx, 14, 11583, 6049)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func Test_httpTileStore_url(t *testing.T) {
+	ts, err := NewHTTPTileStore("https://host/{z}/{x}/{-y}.png", "", nil, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "https://host/2/1/2.png", ts.tileURL(2, 1, 1))
+
+	_, err = NewHTTPTileStore("https://host/{z}/{y}.png", "", nil, 0, 0)
+	assert.Error(t, err)
+
+	_, err = NewHTTPTileStore("https://host/{z}/{x}/{y}.png?key={apikey}", "", nil, 0, 0)
+	assert.Error(t, err)
+}
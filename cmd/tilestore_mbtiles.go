@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	_ "modernc.org/sqlite"
+)
+
+// MBTilesTileStore reads and writes tiles stored in MBTiles (SQLite) file.
+// MBTiles uses TMS tile rows, store converts them from/to XYZ tile rows.
+type MBTilesTileStore struct {
+	db       *sql.DB
+	fileName string
+}
+
+// NewMBTilesTileStore opens existing MBTiles file for reading
+func NewMBTilesTileStore(fileName string) (*MBTilesTileStore, error) {
+	if _, err := os.Stat(fileName); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// validate schema
+	_, err = db.Exec("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles LIMIT 1")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: invalid mbtiles: %w", fileName, err)
+	}
+
+	ts := MBTilesTileStore{
+		db:       db,
+		fileName: fileName,
+	}
+	return &ts, nil
+}
+
+// CreateMBTilesTileStore creates new MBTiles file to be used as output target,
+// existing file is replaced
+func CreateMBTilesTileStore(fileName string) (*MBTilesTileStore, error) {
+	err := os.Remove(fileName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	stmts := []string{
+		"CREATE TABLE metadata (name TEXT, value TEXT)",
+		"CREATE UNIQUE INDEX metadata_name ON metadata (name)",
+		"CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB)",
+		"CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row)",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	ts := MBTilesTileStore{
+		db:       db,
+		fileName: fileName,
+	}
+	return &ts, nil
+}
+
+func (ts *MBTilesTileStore) ClearTile(ctx context.Context, z uint32, x uint32, y uint32) {
+}
+
+func (ts *MBTilesTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32) ([]byte, error) {
+	var data []byte
+	err := ts.db.QueryRowContext(ctx,
+		"SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?",
+		z, x, tmsTileRow(z, y)).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTileNotFound
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (ts *MBTilesTileStore) PutTile(ctx context.Context, z uint32, x uint32, y uint32, data []byte) error {
+	_, err := ts.db.ExecContext(ctx,
+		"INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)",
+		z, x, tmsTileRow(z, y), data)
+	return err
+}
+
+func (ts *MBTilesTileStore) SetMetadata(ctx context.Context, name string, value string) error {
+	_, err := ts.db.ExecContext(ctx,
+		"INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)", name, value)
+	return err
+}
+
+func (ts *MBTilesTileStore) Close() error {
+	return ts.db.Close()
+}
+
+// tmsTileRow flips tile row between XYZ and TMS schemes
+func tmsTileRow(z uint32, y uint32) uint32 {
+	return (uint32(1) << z) - 1 - y
+}
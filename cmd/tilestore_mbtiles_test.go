@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_mbtilesTileStore_1(t *testing.T) {
+	dat, err := os.ReadFile("./test_data/terrarium_14_11583_6049.png")
+	require.NoError(t, err)
+
+	fName := filepath.Join(t.TempDir(), "terrain.mbtiles")
+
+	ctx := context.Background()
+
+	tw, err := CreateMBTilesTileStore(fName)
+	require.NoError(t, err)
+	require.NoError(t, tw.SetMetadata(ctx, "format", "png"))
+	require.NoError(t, tw.PutTile(ctx, 14, 11583, 6049, dat))
+
+	// tile rows are stored in TMS scheme
+	var tileRow uint32
+	err = tw.db.QueryRow("SELECT tile_row FROM tiles WHERE zoom_level = 14 AND tile_column = 11583").Scan(&tileRow)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1<<14-1-6049), tileRow)
+
+	require.NoError(t, tw.Close())
+
+	ts, err := NewMBTilesTileStore(fName)
+	require.NoError(t, err)
+	defer ts.Close()
+
+	tile, err := ts.GetTile(ctx, 14, 11583, 6049)
+	require.NoError(t, err)
+	assert.Equal(t, dat, tile)
+
+	_, err = ts.GetTile(ctx, 14, 11583, 6050)
+	assert.Equal(t, ErrTileNotFound, err)
+}
+
+func Test_export_mbtiles_1(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/terrain/{z}/{x}/{y}.img", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		fmt.Fprintf(w, "%s/%s/%s", vars["z"], vars["x"], vars["y"])
+	})
+
+	bound, err := parseBBox("151.0,-34.0,151.1,-33.8")
+	require.NoError(t, err)
+
+	fName := filepath.Join(t.TempDir(), "out.mbtiles")
+	tw, err := newTileWriter(fName)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	cnt, err := exportTiles(ctx, r, tw, exportLayers["terrain"], "", 10, 11, bound)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	// 1 tile at z10 and 1x2 tiles at z11
+	assert.Equal(t, 3, cnt)
+
+	ts, err := NewMBTilesTileStore(fName)
+	require.NoError(t, err)
+	defer ts.Close()
+
+	tile, err := ts.GetTile(ctx, 11, 1883, 1229)
+	require.NoError(t, err)
+	assert.Equal(t, "11/1883/1229", string(tile))
+}
@@ -0,0 +1,747 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	lrucache "github.com/hashicorp/golang-lru"
+)
+
+// PMTiles v3 archive format
+// https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+
+const (
+	pmtilesHeaderSize = 127
+	// root directory has to fit with header into first 16K of archive
+	pmtilesMaxRootDirSize = 16384 - pmtilesHeaderSize
+	pmtilesMaxDirDepth    = 3
+	pmtilesLeafCacheSize  = 64
+)
+
+type pmtilesCompression uint8
+
+const (
+	pmtilesCompressionUnknown pmtilesCompression = 0
+	pmtilesCompressionNone    pmtilesCompression = 1
+	pmtilesCompressionGzip    pmtilesCompression = 2
+	pmtilesCompressionBrotli  pmtilesCompression = 3
+	pmtilesCompressionZstd    pmtilesCompression = 4
+)
+
+type pmtilesTileType uint8
+
+const (
+	pmtilesTileTypeUnknown pmtilesTileType = 0
+	pmtilesTileTypeMVT     pmtilesTileType = 1
+	pmtilesTileTypePNG     pmtilesTileType = 2
+	pmtilesTileTypeJPEG    pmtilesTileType = 3
+	pmtilesTileTypeWebP    pmtilesTileType = 4
+)
+
+type pmtilesHeader struct {
+	RootOffset          uint64
+	RootLength          uint64
+	MetadataOffset      uint64
+	MetadataLength      uint64
+	LeafDirectoryOffset uint64
+	LeafDirectoryLength uint64
+	TileDataOffset      uint64
+	TileDataLength      uint64
+	AddressedTilesCount uint64
+	TileEntriesCount    uint64
+	TileContentsCount   uint64
+	Clustered           bool
+	InternalCompression pmtilesCompression
+	TileCompression     pmtilesCompression
+	TileType            pmtilesTileType
+	MinZoom             uint8
+	MaxZoom             uint8
+	MinLonE7            int32
+	MinLatE7            int32
+	MaxLonE7            int32
+	MaxLatE7            int32
+	CenterZoom          uint8
+	CenterLonE7         int32
+	CenterLatE7         int32
+}
+
+// pmtilesEntry addresses either run of RunLength tiles starting at TileID
+// or leaf directory when RunLength is 0
+type pmtilesEntry struct {
+	TileID    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+func decodePMTilesHeader(data []byte) (pmtilesHeader, error) {
+	var h pmtilesHeader
+	if len(data) < pmtilesHeaderSize {
+		return h, errors.New("pmtiles: header too short")
+	}
+	if string(data[0:7]) != "PMTiles" {
+		return h, errors.New("pmtiles: invalid magic number")
+	}
+	if data[7] != 3 {
+		return h, fmt.Errorf("pmtiles: unsupported spec version %d", data[7])
+	}
+
+	le := binary.LittleEndian
+	h.RootOffset = le.Uint64(data[8:16])
+	h.RootLength = le.Uint64(data[16:24])
+	h.MetadataOffset = le.Uint64(data[24:32])
+	h.MetadataLength = le.Uint64(data[32:40])
+	h.LeafDirectoryOffset = le.Uint64(data[40:48])
+	h.LeafDirectoryLength = le.Uint64(data[48:56])
+	h.TileDataOffset = le.Uint64(data[56:64])
+	h.TileDataLength = le.Uint64(data[64:72])
+	h.AddressedTilesCount = le.Uint64(data[72:80])
+	h.TileEntriesCount = le.Uint64(data[80:88])
+	h.TileContentsCount = le.Uint64(data[88:96])
+	h.Clustered = data[96] == 1
+	h.InternalCompression = pmtilesCompression(data[97])
+	h.TileCompression = pmtilesCompression(data[98])
+	h.TileType = pmtilesTileType(data[99])
+	h.MinZoom = data[100]
+	h.MaxZoom = data[101]
+	h.MinLonE7 = int32(le.Uint32(data[102:106]))
+	h.MinLatE7 = int32(le.Uint32(data[106:110]))
+	h.MaxLonE7 = int32(le.Uint32(data[110:114]))
+	h.MaxLatE7 = int32(le.Uint32(data[114:118]))
+	h.CenterZoom = data[118]
+	h.CenterLonE7 = int32(le.Uint32(data[119:123]))
+	h.CenterLatE7 = int32(le.Uint32(data[123:127]))
+
+	return h, nil
+}
+
+func encodePMTilesHeader(h pmtilesHeader) []byte {
+	data := make([]byte, pmtilesHeaderSize)
+	copy(data[0:7], "PMTiles")
+	data[7] = 3
+
+	le := binary.LittleEndian
+	le.PutUint64(data[8:16], h.RootOffset)
+	le.PutUint64(data[16:24], h.RootLength)
+	le.PutUint64(data[24:32], h.MetadataOffset)
+	le.PutUint64(data[32:40], h.MetadataLength)
+	le.PutUint64(data[40:48], h.LeafDirectoryOffset)
+	le.PutUint64(data[48:56], h.LeafDirectoryLength)
+	le.PutUint64(data[56:64], h.TileDataOffset)
+	le.PutUint64(data[64:72], h.TileDataLength)
+	le.PutUint64(data[72:80], h.AddressedTilesCount)
+	le.PutUint64(data[80:88], h.TileEntriesCount)
+	le.PutUint64(data[88:96], h.TileContentsCount)
+	if h.Clustered {
+		data[96] = 1
+	}
+	data[97] = uint8(h.InternalCompression)
+	data[98] = uint8(h.TileCompression)
+	data[99] = uint8(h.TileType)
+	data[100] = h.MinZoom
+	data[101] = h.MaxZoom
+	le.PutUint32(data[102:106], uint32(h.MinLonE7))
+	le.PutUint32(data[106:110], uint32(h.MinLatE7))
+	le.PutUint32(data[110:114], uint32(h.MaxLonE7))
+	le.PutUint32(data[114:118], uint32(h.MaxLatE7))
+	data[118] = h.CenterZoom
+	le.PutUint32(data[119:123], uint32(h.CenterLonE7))
+	le.PutUint32(data[123:127], uint32(h.CenterLatE7))
+
+	return data
+}
+
+func serializePMTilesDirectory(entries []pmtilesEntry) []byte {
+	data := make([]byte, 0, len(entries)*8)
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		data = append(data, buf[:n]...)
+	}
+
+	putUvarint(uint64(len(entries)))
+
+	var lastID uint64
+	for _, e := range entries {
+		putUvarint(e.TileID - lastID)
+		lastID = e.TileID
+	}
+	for _, e := range entries {
+		putUvarint(uint64(e.RunLength))
+	}
+	for _, e := range entries {
+		putUvarint(uint64(e.Length))
+	}
+	for idx, e := range entries {
+		if idx > 0 && e.Offset == entries[idx-1].Offset+uint64(entries[idx-1].Length) {
+			putUvarint(0)
+		} else {
+			putUvarint(e.Offset + 1)
+		}
+	}
+
+	return data
+}
+
+func deserializePMTilesDirectory(data []byte) ([]pmtilesEntry, error) {
+	r := bytes.NewReader(data)
+
+	numEntries, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// each entry takes at least 4 bytes
+	if numEntries > uint64(len(data)) {
+		return nil, errors.New("pmtiles: invalid directory")
+	}
+
+	entries := make([]pmtilesEntry, numEntries)
+
+	var lastID uint64
+	for idx := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		lastID += v
+		entries[idx].TileID = lastID
+	}
+	for idx := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[idx].RunLength = uint32(v)
+	}
+	for idx := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		entries[idx].Length = uint32(v)
+	}
+	for idx := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if v == 0 && idx > 0 {
+			entries[idx].Offset = entries[idx-1].Offset + uint64(entries[idx-1].Length)
+		} else {
+			entries[idx].Offset = v - 1
+		}
+	}
+
+	return entries, nil
+}
+
+// findPMTilesEntry returns entry containing tile or leaf directory which may contain tile
+func findPMTilesEntry(entries []pmtilesEntry, tileID uint64) (pmtilesEntry, bool) {
+	idx := sort.Search(len(entries), func(i int) bool {
+		return entries[i].TileID > tileID
+	}) - 1
+	if idx < 0 {
+		return pmtilesEntry{}, false
+	}
+
+	e := entries[idx]
+	if e.RunLength == 0 {
+		return e, true
+	}
+	if tileID-e.TileID < uint64(e.RunLength) {
+		return e, true
+	}
+	return pmtilesEntry{}, false
+}
+
+// pmtilesZxyToID converts tile coordinates into position on Hilbert curve
+// accumulated over all lower zoom levels
+func pmtilesZxyToID(z uint32, x uint32, y uint32) uint64 {
+	var acc uint64
+	for tz := uint32(0); tz < z; tz++ {
+		acc += uint64(1) << (2 * tz)
+	}
+
+	n := uint32(1) << z
+	var d uint64
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint32
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		if ry == 0 {
+			if rx == 1 {
+				x = n - 1 - x
+				y = n - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+
+	return acc + d
+}
+
+func pmtilesDecompress(data []byte, compression pmtilesCompression) ([]byte, error) {
+	switch compression {
+	case pmtilesCompressionNone, pmtilesCompressionUnknown:
+		return data, nil
+	case pmtilesCompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	default:
+		return nil, fmt.Errorf("pmtiles: unsupported compression %d", compression)
+	}
+}
+
+// PMTilesTileStore reads tiles from local PMTiles v3 archive
+type PMTilesTileStore struct {
+	f         *os.File
+	header    pmtilesHeader
+	rootDir   []pmtilesEntry
+	leafCache *lrucache.Cache
+}
+
+func NewPMTilesTileStore(fileName string) (*PMTilesTileStore, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := newPMTilesTileStore(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return ts, nil
+}
+
+func newPMTilesTileStore(f *os.File) (*PMTilesTileStore, error) {
+	headerData := make([]byte, pmtilesHeaderSize)
+	_, err := f.ReadAt(headerData, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := decodePMTilesHeader(headerData)
+	if err != nil {
+		return nil, err
+	}
+
+	leafCache, err := lrucache.New(pmtilesLeafCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := PMTilesTileStore{
+		f:         f,
+		header:    header,
+		leafCache: leafCache,
+	}
+
+	ts.rootDir, err = ts.readDirectory(header.RootOffset, header.RootLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ts, nil
+}
+
+func (ts *PMTilesTileStore) readDirectory(offset uint64, length uint64) ([]pmtilesEntry, error) {
+	data := make([]byte, length)
+	_, err := ts.f.ReadAt(data, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = pmtilesDecompress(data, ts.header.InternalCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	return deserializePMTilesDirectory(data)
+}
+
+func (ts *PMTilesTileStore) leafDirectory(offset uint64, length uint64) ([]pmtilesEntry, error) {
+	key := fmt.Sprintf("%d_%d", offset, length)
+
+	obj, ok := ts.leafCache.Get(key)
+	if ok {
+		if entries, ok := obj.([]pmtilesEntry); ok {
+			return entries, nil
+		}
+	}
+
+	entries, err := ts.readDirectory(ts.header.LeafDirectoryOffset+offset, length)
+	if err != nil {
+		return nil, err
+	}
+	ts.leafCache.Add(key, entries)
+
+	return entries, nil
+}
+
+func (ts *PMTilesTileStore) ClearTile(ctx context.Context, z uint32, x uint32, y uint32) {
+}
+
+func (ts *PMTilesTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32) ([]byte, error) {
+	if z < uint32(ts.header.MinZoom) || z > uint32(ts.header.MaxZoom) {
+		return nil, ErrTileNotFound
+	}
+
+	tileID := pmtilesZxyToID(z, x, y)
+
+	dir := ts.rootDir
+	for depth := 0; depth <= pmtilesMaxDirDepth; depth++ {
+		e, ok := findPMTilesEntry(dir, tileID)
+		if !ok {
+			return nil, ErrTileNotFound
+		}
+
+		if e.RunLength > 0 {
+			data := make([]byte, e.Length)
+			_, err := ts.f.ReadAt(data, int64(ts.header.TileDataOffset+e.Offset))
+			if err != nil {
+				return nil, err
+			}
+			return pmtilesDecompress(data, ts.header.TileCompression)
+		}
+
+		var err error
+		dir, err = ts.leafDirectory(e.Offset, uint64(e.Length))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("pmtiles: directory depth exceeded")
+}
+
+func (ts *PMTilesTileStore) Close() error {
+	return ts.f.Close()
+}
+
+// PMTilesTileWriter packages tiles into PMTiles v3 archive.
+// Tiles are spooled into temporary file and archive is assembled on Close
+// with tiles clustered in tile id order and identical tiles deduplicated.
+type PMTilesTileWriter struct {
+	fileName       string
+	tmpFile        *os.File
+	tmpOffset      uint64
+	entries        []pmtilesEntry
+	metadata       map[string]string
+	maxRootDirSize int
+
+	lock sync.Mutex
+}
+
+func CreatePMTilesTileWriter(fileName string) (*PMTilesTileWriter, error) {
+	tmpFile, err := os.CreateTemp("", "pmtiles-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	tw := PMTilesTileWriter{
+		fileName:       fileName,
+		tmpFile:        tmpFile,
+		metadata:       make(map[string]string),
+		maxRootDirSize: pmtilesMaxRootDirSize,
+	}
+	return &tw, nil
+}
+
+func (tw *PMTilesTileWriter) PutTile(ctx context.Context, z uint32, x uint32, y uint32, data []byte) error {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	_, err := tw.tmpFile.Write(data)
+	if err != nil {
+		return err
+	}
+
+	tw.entries = append(tw.entries, pmtilesEntry{
+		TileID:    pmtilesZxyToID(z, x, y),
+		Offset:    tw.tmpOffset,
+		Length:    uint32(len(data)),
+		RunLength: 1,
+	})
+	tw.tmpOffset += uint64(len(data))
+
+	return nil
+}
+
+func (tw *PMTilesTileWriter) SetMetadata(ctx context.Context, name string, value string) error {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	tw.metadata[name] = value
+	return nil
+}
+
+func (tw *PMTilesTileWriter) Close() error {
+	tw.lock.Lock()
+	defer tw.lock.Unlock()
+
+	defer func() {
+		tw.tmpFile.Close()
+		os.Remove(tw.tmpFile.Name())
+	}()
+
+	return tw.writeArchive()
+}
+
+func (tw *PMTilesTileWriter) readTmpTile(e pmtilesEntry) ([]byte, error) {
+	data := make([]byte, e.Length)
+	_, err := tw.tmpFile.ReadAt(data, int64(e.Offset))
+	return data, err
+}
+
+func (tw *PMTilesTileWriter) writeArchive() error {
+	// last written tile wins
+	sort.SliceStable(tw.entries, func(i, j int) bool {
+		return tw.entries[i].TileID < tw.entries[j].TileID
+	})
+	tmpEntries := make([]pmtilesEntry, 0, len(tw.entries))
+	for _, e := range tw.entries {
+		if len(tmpEntries) > 0 && tmpEntries[len(tmpEntries)-1].TileID == e.TileID {
+			tmpEntries[len(tmpEntries)-1] = e
+			continue
+		}
+		tmpEntries = append(tmpEntries, e)
+	}
+
+	// assign tile data offsets, deduplicate identical tile contents
+	// and merge consecutive identical tiles into runs
+	contentOffsets := make(map[[sha256.Size]byte]uint64)
+	entries := make([]pmtilesEntry, 0, len(tmpEntries))
+	contents := make([]pmtilesEntry, 0, len(tmpEntries))
+	var tileDataLength uint64
+
+	for _, e := range tmpEntries {
+		data, err := tw.readTmpTile(e)
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.Sum256(data)
+		offset, ok := contentOffsets[hash]
+		if !ok {
+			offset = tileDataLength
+			contentOffsets[hash] = offset
+			contents = append(contents, e)
+			tileDataLength += uint64(e.Length)
+		}
+
+		if len(entries) > 0 {
+			last := &entries[len(entries)-1]
+			if last.Offset == offset && last.TileID+uint64(last.RunLength) == e.TileID {
+				last.RunLength++
+				continue
+			}
+		}
+		entries = append(entries, pmtilesEntry{
+			TileID:    e.TileID,
+			Offset:    offset,
+			Length:    e.Length,
+			RunLength: 1,
+		})
+	}
+
+	rootDir, leafDirs, err := buildPMTilesDirectories(entries, tw.maxRootDirSize)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := json.Marshal(tw.metadata)
+	if err != nil {
+		return err
+	}
+	metadata, err = gzipData(metadata)
+	if err != nil {
+		return err
+	}
+
+	header := pmtilesHeader{
+		RootOffset:          pmtilesHeaderSize,
+		RootLength:          uint64(len(rootDir)),
+		MetadataOffset:      pmtilesHeaderSize + uint64(len(rootDir)),
+		MetadataLength:      uint64(len(metadata)),
+		TileDataLength:      tileDataLength,
+		AddressedTilesCount: uint64(len(tmpEntries)),
+		TileEntriesCount:    uint64(len(entries)),
+		TileContentsCount:   uint64(len(contents)),
+		Clustered:           true,
+		InternalCompression: pmtilesCompressionGzip,
+		TileCompression:     pmtilesCompressionNone,
+		TileType:            pmtilesTileTypeUnknown,
+	}
+	header.LeafDirectoryOffset = header.MetadataOffset + header.MetadataLength
+	header.LeafDirectoryLength = uint64(len(leafDirs))
+	header.TileDataOffset = header.LeafDirectoryOffset + header.LeafDirectoryLength
+
+	switch tw.metadata["format"] {
+	case "png":
+		header.TileType = pmtilesTileTypePNG
+	case "jpg":
+		header.TileType = pmtilesTileTypeJPEG
+	case "webp":
+		header.TileType = pmtilesTileTypeWebP
+	case "pbf":
+		// vector tiles are written gzipped, same as in MBTiles
+		header.TileType = pmtilesTileTypeMVT
+		header.TileCompression = pmtilesCompressionGzip
+	}
+
+	tw.setHeaderBounds(&header, tmpEntries)
+
+	f, err := os.Create(tw.fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, data := range [][]byte{encodePMTilesHeader(header), rootDir, metadata, leafDirs} {
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range contents {
+		data, err := tw.readTmpTile(e)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+func (tw *PMTilesTileWriter) setHeaderBounds(header *pmtilesHeader, entries []pmtilesEntry) {
+	header.MinLonE7 = -180 * 1e7
+	header.MinLatE7 = -85 * 1e7
+	header.MaxLonE7 = 180 * 1e7
+	header.MaxLatE7 = 85 * 1e7
+
+	if len(entries) > 0 {
+		header.MinZoom = math.MaxUint8
+		for _, e := range entries {
+			z := pmtilesIDToZoom(e.TileID)
+			if z < header.MinZoom {
+				header.MinZoom = z
+			}
+			if z > header.MaxZoom {
+				header.MaxZoom = z
+			}
+		}
+	}
+
+	if bounds, ok := tw.metadata["bounds"]; ok {
+		parts := strings.Split(bounds, ",")
+		if len(parts) == 4 {
+			vals := make([]int32, 4)
+			for idx, p := range parts {
+				v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+				if err != nil {
+					return
+				}
+				vals[idx] = int32(v * 1e7)
+			}
+			header.MinLonE7 = vals[0]
+			header.MinLatE7 = vals[1]
+			header.MaxLonE7 = vals[2]
+			header.MaxLatE7 = vals[3]
+		}
+	}
+
+	header.CenterZoom = header.MinZoom
+	header.CenterLonE7 = header.MinLonE7/2 + header.MaxLonE7/2
+	header.CenterLatE7 = header.MinLatE7/2 + header.MaxLatE7/2
+}
+
+func pmtilesIDToZoom(tileID uint64) uint8 {
+	var acc uint64
+	for z := uint8(0); z < 32; z++ {
+		numTiles := uint64(1) << (2 * uint64(z))
+		if tileID < acc+numTiles {
+			return z
+		}
+		acc += numTiles
+	}
+	return 31
+}
+
+// buildPMTilesDirectories serializes entries into root directory,
+// splitting them into leaf directories when root does not fit into maxRootDirSize
+func buildPMTilesDirectories(entries []pmtilesEntry, maxRootDirSize int) ([]byte, []byte, error) {
+	rootDir, err := gzipData(serializePMTilesDirectory(entries))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rootDir) <= maxRootDirSize {
+		return rootDir, nil, nil
+	}
+
+	leafSize := 4096
+	if leafSize > len(entries)/2 {
+		leafSize = len(entries)/2 + 1
+	}
+
+	for {
+		rootEntries := make([]pmtilesEntry, 0)
+		leafDirs := make([]byte, 0)
+
+		for idx := 0; idx < len(entries); idx += leafSize {
+			end := idx + leafSize
+			if end > len(entries) {
+				end = len(entries)
+			}
+
+			leafDir, err := gzipData(serializePMTilesDirectory(entries[idx:end]))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			rootEntries = append(rootEntries, pmtilesEntry{
+				TileID:    entries[idx].TileID,
+				Offset:    uint64(len(leafDirs)),
+				Length:    uint32(len(leafDir)),
+				RunLength: 0,
+			})
+			leafDirs = append(leafDirs, leafDir...)
+		}
+
+		rootDir, err := gzipData(serializePMTilesDirectory(rootEntries))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rootDir) <= maxRootDirSize {
+			return rootDir, leafDirs, nil
+		}
+
+		leafSize *= 2
+	}
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_pmtilesZxyToID(t *testing.T) {
+	testData := []struct {
+		z, x, y uint32
+		id      uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1},
+		{1, 0, 1, 2},
+		{1, 1, 1, 3},
+		{1, 1, 0, 4},
+		{2, 0, 0, 5},
+		{3, 0, 0, 21},
+		{3, 7, 0, 84},
+	}
+
+	for _, tst := range testData {
+		id := pmtilesZxyToID(tst.z, tst.x, tst.y)
+		assert.Equal(t, tst.id, id, "z=%d, x=%d, y=%d", tst.z, tst.x, tst.y)
+		assert.Equal(t, uint8(tst.z), pmtilesIDToZoom(id))
+	}
+}
+
+func Test_pmtilesDirectory(t *testing.T) {
+	entries := []pmtilesEntry{
+		{TileID: 5, Offset: 0, Length: 10, RunLength: 1},
+		{TileID: 6, Offset: 10, Length: 20, RunLength: 3},
+		{TileID: 100, Offset: 0, Length: 10, RunLength: 1},
+		{TileID: 101, Offset: 10, Length: 20, RunLength: 0},
+	}
+
+	out, err := deserializePMTilesDirectory(serializePMTilesDirectory(entries))
+	require.NoError(t, err)
+	assert.Equal(t, entries, out)
+
+	e, ok := findPMTilesEntry(entries, 8)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(6), e.TileID)
+
+	_, ok = findPMTilesEntry(entries, 9)
+	assert.False(t, ok)
+
+	_, ok = findPMTilesEntry(entries, 4)
+	assert.False(t, ok)
+}
+
+func Test_pmtilesTileStore_1(t *testing.T) {
+	dat, err := os.ReadFile("./test_data/terrarium_14_11583_6049.png")
+	require.NoError(t, err)
+
+	testData := []struct {
+		name           string
+		format         string
+		maxRootDirSize int
+	}{
+		{"root", "png", pmtilesMaxRootDirSize},
+		{"leaves", "png", 64},
+		{"gzip", "pbf", pmtilesMaxRootDirSize},
+	}
+
+	for _, tst := range testData {
+		t.Run(tst.name, func(t *testing.T) {
+			fName := filepath.Join(t.TempDir(), "terrain.pmtiles")
+
+			ctx := context.Background()
+
+			tw, err := CreatePMTilesTileWriter(fName)
+			require.NoError(t, err)
+			tw.maxRootDirSize = tst.maxRootDirSize
+
+			require.NoError(t, tw.SetMetadata(ctx, "format", tst.format))
+
+			// vector tiles are expected to be gzipped by caller
+			putTile := func(z, x, y uint32, data []byte) {
+				if tst.format == "pbf" {
+					data, err = gzipData(data)
+					require.NoError(t, err)
+				}
+				require.NoError(t, tw.PutTile(ctx, z, x, y, data))
+			}
+
+			// same content on consecutive tiles is written as single run
+			for x := uint32(0); x < 8; x++ {
+				for y := uint32(0); y < 8; y++ {
+					putTile(3, x, y, []byte("empty"))
+				}
+			}
+			for x := uint32(0); x < 16; x++ {
+				for y := uint32(0); y < 16; y++ {
+					putTile(4, x, y, []byte(fmt.Sprintf("4/%d/%d", x, y)))
+				}
+			}
+			putTile(14, 11583, 6049, dat)
+			require.NoError(t, tw.Close())
+
+			ts, err := NewPMTilesTileStore(fName)
+			require.NoError(t, err)
+			defer ts.Close()
+
+			assert.Equal(t, uint8(3), ts.header.MinZoom)
+			assert.Equal(t, uint8(14), ts.header.MaxZoom)
+			assert.Equal(t, uint64(64+256+1), ts.header.AddressedTilesCount)
+			assert.Equal(t, uint64(1+256+1), ts.header.TileContentsCount)
+			assert.Equal(t, tst.maxRootDirSize < pmtilesMaxRootDirSize, ts.header.LeafDirectoryLength > 0)
+
+			tile, err := ts.GetTile(ctx, 14, 11583, 6049)
+			require.NoError(t, err)
+			assert.Equal(t, dat, tile)
+
+			tile, err = ts.GetTile(ctx, 3, 5, 2)
+			require.NoError(t, err)
+			assert.Equal(t, "empty", string(tile))
+
+			tile, err = ts.GetTile(ctx, 4, 9, 12)
+			require.NoError(t, err)
+			assert.Equal(t, "4/9/12", string(tile))
+
+			_, err = ts.GetTile(ctx, 14, 11583, 6050)
+			assert.Equal(t, ErrTileNotFound, err)
+
+			_, err = ts.GetTile(ctx, 5, 0, 0)
+			assert.Equal(t, ErrTileNotFound, err)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_s3TileStore_endpoint(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "minioadmin")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+
+	var reqPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqPath = r.URL.Path
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("tile"))
+	}))
+	defer srv.Close()
+
+	s3Cfg := s3Config{
+		region:      "local",
+		bucket:      "terrain",
+		endpoint:    srv.URL,
+		pathStyle:   true,
+		keyTemplate: "terrarium/%d/%d/%d.png",
+	}
+
+	ctx := context.Background()
+
+	ts, err := newS3TileStore(ctx, s3Cfg)
+	require.NoError(t, err)
+
+	tile, err := ts.GetTile(ctx, 14, 11583, 6049)
+	require.NoError(t, err)
+	assert.Equal(t, "tile", string(tile))
+	assert.Equal(t, "/terrain/terrarium/14/11583/6049.png", reqPath)
+
+	s3Cfg.keyTemplate = "terrarium/%d/%d.png"
+	_, err = newS3TileStore(ctx, s3Cfg)
+	assert.Error(t, err)
+}
+
+func Test_cacheTileStore_size(t *testing.T) {
+	ts, err := NewCacheTileStore(tileKeyTempl, 10)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	ts.Add(1, 0, 0, []byte("aaaa"))
+	ts.Add(1, 0, 1, []byte("bbbb"))
+	_, err = ts.GetTile(ctx, 1, 0, 0)
+	require.NoError(t, err)
+
+	// least recently used 1/0/1 is evicted
+	ts.Add(1, 1, 0, []byte("cccc"))
+	_, err = ts.GetTile(ctx, 1, 0, 1)
+	assert.Equal(t, ErrTileNotFound, err)
+
+	// tile larger than cache size is not cached
+	ts.Add(1, 1, 1, []byte("dddddddddddd"))
+	_, err = ts.GetTile(ctx, 1, 1, 1)
+	assert.Equal(t, ErrTileNotFound, err)
+
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 2, Evictions: 1, Entries: 2, Bytes: 8, MaxBytes: 10}, ts.Stats())
+
+	_, err = NewCacheTileStore(tileKeyTempl, 0)
+	assert.Error(t, err)
+}
+
+func Test_elevationTileStore_size(t *testing.T) {
+	ts, err := NewElevationTileStore(tileKeyTempl, 4*TileSize*TileSize)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	data := make([]float32, TileSize*TileSize)
+	for idx := range data {
+		data[idx] = 8848.0 - float32(idx)/256
+	}
+
+	ts.Add(1, 0, 0, data)
+	assert.Equal(t, int64(4*TileSize*TileSize), ts.Stats().Bytes)
+
+	out, err := ts.GetTile(ctx, 1, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, len(data), len(out))
+	// cache hit returns cached heights without copying
+	assert.Same(t, &data[0], &out[0])
+
+	// budget fits single float32 tile, next tile evicts previous one
+	ts.Add(1, 0, 1, data)
+	_, err = ts.GetTile(ctx, 1, 0, 0)
+	assert.Equal(t, ErrTileNotFound, err)
+	assert.Equal(t, 1, ts.Stats().Entries)
+}
+
+func Test_NewTerra_cacheSize(t *testing.T) {
+	h, err := NewTerra(flatTileStore{}, terrariumEncoding{}, 1<<20, 2<<20)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<20), h.cacheTileStore.Stats().MaxBytes)
+	assert.Equal(t, int64(2<<20), h.elevationTileStore.Stats().MaxBytes)
+
+	_, err = NewTerra(flatTileStore{}, terrariumEncoding{}, 0, 2<<20)
+	assert.Error(t, err)
+	_, err = NewTerra(flatTileStore{}, terrariumEncoding{}, 1<<20, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Units is unit of elevations in requests and responses,
+// elevation data is always in meters
+type Units string
+
+const (
+	UnitsMeters Units = "m"
+	UnitsFeet   Units = "ft"
+)
+
+const metersPerFoot = 0.3048
+
+// parseUnits parses units query parameter, meters by default
+func parseUnits(s string) (Units, error) {
+	switch u := Units(s); u {
+	case "":
+		return UnitsMeters, nil
+	case UnitsMeters, UnitsFeet:
+		return u, nil
+	}
+	return "", fmt.Errorf("unsupported units: %s, expected m or ft", s)
+}
+
+// getRequestUnits reads units query parameter, server units by default
+func (h *terra) getRequestUnits(r *http.Request) (Units, error) {
+	v := r.URL.Query().Get("units")
+	if v == "" {
+		return h.units, nil
+	}
+	return parseUnits(v)
+}
+
+// FromMeters converts elevation in meters to units
+func (u Units) FromMeters(v float64) float64 {
+	if u == UnitsFeet {
+		return v / metersPerFoot
+	}
+	return v
+}
+
+// ToMeters converts elevation in units to meters
+func (u Units) ToMeters(v float64) float64 {
+	if u == UnitsFeet {
+		return v * metersPerFoot
+	}
+	return v
+}
+
+// FromMetersGrid converts elevation grid in meters to units in place
+func (u Units) FromMetersGrid(data []float64) {
+	if u == UnitsMeters {
+		return
+	}
+	for idx, v := range data {
+		data[idx] = u.FromMeters(v)
+	}
+}
+
+// getElevationWindowUnits returns elevation window (see getElevationWindow)
+// with elevations converted to units, shared by handlers which output
+// elevations in request units
+func (h *terra) getElevationWindowUnits(ctx context.Context,
+	units Units,
+	zoom int,
+	tile_X int,
+	tile_Y int,
+	border int) ([]float64, int, int, error) {
+
+	data, width, height, err := h.getElevationWindow(ctx, zoom, tile_X, tile_Y, border)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	units.FromMetersGrid(data)
+
+	return data, width, height, nil
+}
+
+// rampStopsUnits returns color ramp stops with heights converted to units
+func rampStopsUnits(gm *gradientMap, units Units) []rampStop {
+	stops := make([]rampStop, 0, len(gm.gradients))
+	for _, c := range gm.gradients {
+		stops = append(stops, rampStop{units.FromMeters(c.Height), c.Hex()})
+	}
+	return stops
+}
@@ -6,16 +6,25 @@ package cmd
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/draw"
 	"image/png"
+	"io"
 	"log"
 	"math"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -29,7 +38,9 @@ import (
 	"github.com/paulmach/orb/maptile"
 	"github.com/paulmach/orb/simplify"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/valri11/surfacemap/slippymath"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/fogleman/contourmap"
 	"github.com/lucasb-eyer/go-colorful"
@@ -50,20 +61,106 @@ func init() {
 	webserverCmd.Flags().String("tls-cert", "", "TLS certificate file")
 	webserverCmd.Flags().String("tls-cert-key", "", "TLS certificate key file")
 	webserverCmd.Flags().Int("port", 8000, "service port to listen")
+	addTileSourceFlags(webserverCmd)
+}
+
+func addTileSourceFlags(cmd *cobra.Command) {
+	cmd.Flags().String("tile-source", TileSourceS3, "elevation tiles source (s3, dir, mbtiles, pmtiles, http)")
+	cmd.Flags().String("tile-dir", "", "local directory with {z}/{x}/{y}.png elevation tiles")
+	cmd.Flags().String("tile-file", "", "elevation tiles archive file (mbtiles, pmtiles)")
+	cmd.Flags().String("tile-encoding", ElevationEncodingTerrarium, "elevation tiles encoding (terrarium, terrain-rgb, gray16)")
+	cmd.Flags().String("s3-bucket", defaultTilesBucket, "S3 bucket with elevation tiles")
+	cmd.Flags().String("s3-region", defaultAwsRegion, "S3 bucket region")
+	cmd.Flags().String("s3-endpoint", "", "S3 compatible service endpoint URL, e.g. http://localhost:9000")
+	cmd.Flags().Bool("s3-path-style", false, "use path-style addressing for S3 bucket")
+	cmd.Flags().String("s3-key-template", defaultTileKeyTempl, "S3 object key template for z, x, y tile coordinates")
+	cmd.Flags().String("http-url", "", "XYZ tile server URL template, e.g. https://host/{z}/{x}/{y}.png?key={apikey}")
+	cmd.Flags().String("http-api-key", "", "API key for {apikey} placeholder in tile URL template")
+	cmd.Flags().StringToString("http-header", nil, "extra HTTP request headers, e.g. Authorization=...")
+	cmd.Flags().Duration("http-timeout", defaultHTTPTimeout, "tile server request timeout")
+	cmd.Flags().Int("http-retries", defaultHTTPRetries, "number of retries of failed tile server requests")
+	cmd.Flags().Int64("cache-size", defaultTileCacheSize, "max size of in-memory elevation tiles cache in bytes")
+	cmd.Flags().Int64("elevation-cache-size", defaultElevationCacheSize, "max size of in-memory decoded elevation data cache in bytes")
+	cmd.Flags().String("disk-cache-dir", "", "directory of persistent elevation tiles cache (disabled if empty)")
+	cmd.Flags().Int64("disk-cache-size", defaultDiskCacheSize, "max size of persistent elevation tiles cache in bytes")
+	cmd.Flags().String("disk-cache-eviction", string(EvictionLRU), "persistent cache eviction policy (lru, lfu)")
+}
+
+// bindTileSourceFlags binds tile source flags of executed command to config keys,
+// so they can be set in config file or environment
+func bindTileSourceFlags(cmd *cobra.Command) error {
+	bindings := []struct {
+		key  string
+		flag string
+	}{
+		{"tile-source", "tile-source"},
+		{"tile-dir", "tile-dir"},
+		{"tile-file", "tile-file"},
+		{"tile-encoding", "tile-encoding"},
+		{"s3.bucket", "s3-bucket"},
+		{"s3.region", "s3-region"},
+		{"s3.endpoint", "s3-endpoint"},
+		{"s3.path-style", "s3-path-style"},
+		{"s3.key-template", "s3-key-template"},
+		{"http.url", "http-url"},
+		{"http.api-key", "http-api-key"},
+		{"http.headers", "http-header"},
+		{"http.timeout", "http-timeout"},
+		{"http.retries", "http-retries"},
+		{"cache.size", "cache-size"},
+		{"cache.elevation-size", "elevation-cache-size"},
+		{"disk-cache.dir", "disk-cache-dir"},
+		{"disk-cache.size", "disk-cache-size"},
+		{"disk-cache.eviction", "disk-cache-eviction"},
+	}
+	for _, b := range bindings {
+		err := viper.BindPFlag(b.key, cmd.Flags().Lookup(b.flag))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 const (
-	tilesBucket = "elevation-tiles-prod"
-	awsRegion   = "us-east-1"
+	defaultTilesBucket  = "elevation-tiles-prod"
+	defaultAwsRegion    = "us-east-1"
+	defaultTileKeyTempl = "v2/terrarium/%d/%d/%d.png"
+
+	// key of tile in caches and logs
+	tileKeyTempl = "%d/%d/%d"
 )
 
 const (
-	CacheSize = 4 * 512
-	TileSize  = 256
+	TileSourceS3      = "s3"
+	TileSourceDir     = "dir"
+	TileSourceMBTiles = "mbtiles"
+	TileSourcePMTiles = "pmtiles"
+	TileSourceHTTP    = "http"
+)
+
+const (
+	TileSize = 256
+
+	defaultTileCacheSize      = 256 << 20
+	defaultElevationCacheSize = 512 << 20
+	defaultDiskCacheSize      = 1 << 30
 
 	epsilon = 0.00001
 
 	MaxConcurrency = 8
+
+	// time for in-flight requests to complete on shutdown
+	shutdownTimeout = 15 * time.Second
+
+	// limit of tile fetch and decode shared by concurrent requests
+	sharedFetchTimeout = 30 * time.Second
+)
+
+const (
+	HillshadeModeGray        = "gray"
+	HillshadeModeTransparent = "transparent"
+	HillshadeModeInverted    = "inverted"
 )
 
 type FeatureOutFormat string
@@ -74,80 +171,87 @@ const (
 )
 
 type s3Config struct {
-	region string
-	bucket string
+	region      string
+	bucket      string
+	endpoint    string
+	pathStyle   bool
+	keyTemplate string
 }
 
 type terra struct {
-	cfg                aws.Config
-	s3Config           s3Config
-	s3Client           *s3.Client
-	s3TileStore        *S3TileStore
+	tileStore          TileStore
+	elevationDecoder   ElevationDecoder
 	cacheTileStore     *CacheTileStore
+	diskCacheTileStore *DiskCacheTileStore
 	elevationTileStore *ElevationTileStore
-	gradientMap        *gradientMap
+	reliefRamps        map[string]*gradientMap
+	defaultReliefRamp  string
+	slopeRamps         map[string]ColorRamp
+	defaultSlopeRamp   string
+	triRamp            ColorRamp
+	tpiRamp            ColorRamp
+	curvatureRamp      ColorRamp
+	contourIntervals   map[Units][]zoomInterval
+	units              Units
+
+	tileGroup      singleflight.Group
+	elevationGroup singleflight.Group
 }
 
-func NewTerra(cfg aws.Config, s3Config s3Config) (*terra, error) {
-
-	s3Client := s3.NewFromConfig(cfg)
-
-	tileNameTempl := "v2/terrarium/%d/%d/%d.png"
+// NewTerra creates terra with memory caches of source tiles and decoded
+// elevation data bounded by cacheSize and elevationCacheSize bytes
+func NewTerra(tileStore TileStore, elevationDecoder ElevationDecoder,
+	cacheSize int64, elevationCacheSize int64) (*terra, error) {
 
-	s3TileStore, err := NewS3TileStore(s3Client, s3Config.bucket, tileNameTempl)
+	cacheTileStore, err := NewCacheTileStore(tileKeyTempl, cacheSize)
 	if err != nil {
 		return nil, err
 	}
 
-	cacheTileStore, err := NewCacheTileStore(tileNameTempl, CacheSize)
+	elevationTileStore, err := NewElevationTileStore(tileKeyTempl, elevationCacheSize)
 	if err != nil {
 		return nil, err
 	}
 
-	elevationTileStore, err := NewElevationTileStore(tileNameTempl, CacheSize)
+	reliefRamps, err := newReliefRamps(nil)
 	if err != nil {
 		return nil, err
 	}
 
-	// < 0  40 120 160 #2878a0
-
-	// 0    110 220 110 #6edc6e
-	// 900  240 250 160 #f0faa0
-	// 1300 230 220 170 #e6dcaa
-	// 1900 220 220 220 #dcdcdc
-	// 2500 250 250 250 #fafafa
-
-	//	   0 102 153 153 #0669999
-	//	   1  46 154  88 #2e9a58
-	//	 600 251 255 128 #fbff80
-	//	1200 224 108  31 #e06c1f
-	//	2500 200  55  55 #c83737
-	//	4000 215 244 244 #d7f4f4
+	slopeRamps, err := newSlopeRamps(nil)
+	if err != nil {
+		return nil, err
+	}
 
-	// #066999 0%, #2E9A58 5%, #FBFF80 18%, #E19545 37%, #DA7029 60%, #D7F4F4
+	triRamp, err := newTRIRamp()
+	if err != nil {
+		return nil, err
+	}
 
-	colorCard := []colorCard{
-		{0.00, "#066999"},
-		{0.01, "#2E9A58"},
-		{900.0, "#FBFF80"},
-		{1300.0, "#E19545"},
-		{1900.0, "#DA7029"},
-		{2500.0, "#d7f4f4"},
+	tpiRamp, err := newTPIRamp()
+	if err != nil {
+		return nil, err
 	}
 
-	gm, err := NewGradientMap(colorCard, 0.1)
+	curvatureRamp, err := newCurvatureRamp()
 	if err != nil {
 		return nil, err
 	}
 
 	t := terra{
-		cfg:                cfg,
-		s3Config:           s3Config,
-		s3Client:           s3Client,
-		s3TileStore:        s3TileStore,
+		tileStore:          tileStore,
+		elevationDecoder:   elevationDecoder,
 		cacheTileStore:     cacheTileStore,
 		elevationTileStore: elevationTileStore,
-		gradientMap:        gm,
+		reliefRamps:        reliefRamps,
+		defaultReliefRamp:  defaultReliefRamp,
+		slopeRamps:         slopeRamps,
+		defaultSlopeRamp:   defaultSlopeRamp,
+		triRamp:            triRamp,
+		tpiRamp:            tpiRamp,
+		curvatureRamp:      curvatureRamp,
+		contourIntervals:   defaultContourIntervals,
+		units:              UnitsMeters,
 	}
 	return &t, nil
 }
@@ -182,23 +286,16 @@ func mainCmd(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	ctx := context.Background()
-	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(awsRegion))
-	if err != nil {
-		panic(err)
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	t, err := NewTerra(awsCfg, s3Config{region: awsRegion, bucket: tilesBucket})
+	t, err := newSourceTerra(ctx, cmd)
 	if err != nil {
-		panic(err)
+		log.Fatalf("ERR: %v", err)
+		return
 	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/terra/{z}/{x}/{y}.img", t.tilesHandler)
-	r.HandleFunc("/terra512/{z}/{x}/{y}.img", t.tiles512Handler)
-	r.HandleFunc("/terrain/{z}/{x}/{y}.img", t.tilesTerrainHandler)
-	r.HandleFunc("/contours/{z}/{x}/{y}.{format}", t.tilesContoursHandler)
-	r.HandleFunc("/color-relief/{z}/{x}/{y}.img", t.colorReliefHandler)
+	r := newRouter(t)
 
 	// Where ORIGIN_ALLOWED is like `scheme://dns[:port]`, or `*` (insecure)
 	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "content-type", "username", "password", "Referer"})
@@ -215,16 +312,351 @@ func mainCmd(cmd *cobra.Command, args []string) {
 		WriteTimeout: 30 * time.Second,
 	}
 
-	if devMode {
-		err = srv.ListenAndServe()
-	} else {
-		err = srv.ListenAndServeTLS(tlsCertFile, tlsCertKeyFile)
+	listen := func() error {
+		if devMode {
+			return srv.ListenAndServe()
+		}
+		return srv.ListenAndServeTLS(tlsCertFile, tlsCertKeyFile)
 	}
+	err = serveUntilDone(ctx, srv, listen, t)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// serveUntilDone serves requests until ctx is done, then shuts server
+// down gracefully and closes terra, so disk cache index is flushed
+func serveUntilDone(ctx context.Context, srv *http.Server, listen func() error, t io.Closer) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- listen()
+	}()
+
+	select {
+	case err := <-errCh:
+		t.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if closeErr := t.Close(); err == nil {
+		err = closeErr
+	}
+	if listenErr := <-errCh; err == nil && !errors.Is(listenErr, http.ErrServerClosed) {
+		err = listenErr
+	}
+	return err
+}
+
+func newRouter(t *terra) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/terra/{z}/{x}/{y}.img", t.tilesHandler)
+	r.HandleFunc("/terra512/{z}/{x}/{y}.img", t.tiles512Handler)
+	r.HandleFunc("/terrain/{z}/{x}/{y}.img", t.tilesTerrainHandler)
+	r.HandleFunc("/contours/{z}/{x}/{y}.{format}", t.tilesContoursHandler)
+	r.HandleFunc("/isobands/{z}/{x}/{y}.{format}", t.tilesIsobandsHandler)
+	r.HandleFunc("/color-relief/{z}/{x}/{y}.img", t.colorReliefHandler)
+	r.HandleFunc("/shaded-relief/{z}/{x}/{y}.img", t.shadedReliefHandler)
+	r.HandleFunc("/terrain-rgb/{z}/{x}/{y}.png", t.terrainRGBHandler)
+	r.HandleFunc("/terrarium/{z}/{x}/{y}.png", t.terrariumHandler)
+	r.HandleFunc("/slope/{z}/{x}/{y}.png", t.slopeHandler)
+	r.HandleFunc("/aspect/{z}/{x}/{y}.png", t.aspectHandler)
+	r.HandleFunc("/tri/{z}/{x}/{y}.png", t.triHandler)
+	r.HandleFunc("/tpi/{z}/{x}/{y}.png", t.tpiHandler)
+	r.HandleFunc("/curvature/{kind}/{z}/{x}/{y}.{format}", t.curvatureHandler)
+	r.HandleFunc("/ramps", t.rampsHandler)
+	r.HandleFunc("/stats", t.statsHandler)
+	return r
+}
+
+// newSourceTerra creates terra serving elevation tiles from the source
+// configured by tile source config keys or flags of executed command
+func newSourceTerra(ctx context.Context, cmd *cobra.Command) (*terra, error) {
+	err := bindTileSourceFlags(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	tileStore, err := newSourceTileStore(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	elevationDecoder, err := NewElevationDecoder(viper.GetString("tile-encoding"))
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := NewTerra(tileStore, elevationDecoder,
+		viper.GetInt64("cache.size"), viper.GetInt64("cache.elevation-size"))
+	if err != nil {
+		return nil, err
+	}
+
+	rampConfigs := getColorRampConfigs("color-relief.ramps")
+	if len(rampConfigs) > 0 {
+		ramps, err := loadColorRamps(rampConfigs)
+		if err != nil {
+			return nil, err
+		}
+		t.reliefRamps, err = newReliefRamps(ramps)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rampName := viper.GetString("color-relief.default"); rampName != "" {
+		if _, ok := t.reliefRamps[rampName]; !ok {
+			return nil, fmt.Errorf("unknown default color ramp: %s", rampName)
+		}
+		t.defaultReliefRamp = rampName
+	}
+
+	slopeRampConfigs := getColorRampConfigs("slope.ramps")
+	if len(slopeRampConfigs) > 0 {
+		ramps, err := loadColorRamps(slopeRampConfigs)
+		if err != nil {
+			return nil, err
+		}
+		t.slopeRamps, err = newSlopeRamps(ramps)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rampName := viper.GetString("slope.default"); rampName != "" {
+		if _, ok := t.slopeRamps[rampName]; !ok {
+			return nil, fmt.Errorf("unknown default slope color ramp: %s", rampName)
+		}
+		t.defaultSlopeRamp = rampName
+	}
+
+	t.units, err = parseUnits(viper.GetString("units"))
+	if err != nil {
+		return nil, err
+	}
+
+	t.contourIntervals = make(map[Units][]zoomInterval, len(defaultContourIntervals))
+	for units, table := range defaultContourIntervals {
+		t.contourIntervals[units] = table
+		key := "contours.intervals." + string(units)
+		if !viper.IsSet(key) {
+			continue
+		}
+		t.contourIntervals[units], err = parseContourIntervals(viper.GetStringMapString(key))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	if cacheDir := viper.GetString("disk-cache.dir"); cacheDir != "" {
+		// tiles of different sources and encodings must not be mixed
+		// when cache dir is reused with another configuration
+		cacheDir = filepath.Join(cacheDir,
+			diskCacheNamespace(sourceTileStoreID(), viper.GetString("tile-encoding")))
+		t.diskCacheTileStore, err = NewDiskCacheTileStore(cacheDir,
+			viper.GetInt64("disk-cache.size"),
+			EvictionPolicy(viper.GetString("disk-cache.eviction")))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// newSourceTileStore creates the upstream elevation tiles store
+// selected by the tile-source config key
+func newSourceTileStore(ctx context.Context) (TileStore, error) {
+	tileSource := viper.GetString("tile-source")
+
+	switch tileSource {
+	case TileSourceS3:
+		s3Cfg := s3Config{
+			region:      viper.GetString("s3.region"),
+			bucket:      viper.GetString("s3.bucket"),
+			endpoint:    viper.GetString("s3.endpoint"),
+			pathStyle:   viper.GetBool("s3.path-style"),
+			keyTemplate: viper.GetString("s3.key-template"),
+		}
+		return newS3TileStore(ctx, s3Cfg)
+	case TileSourceDir:
+		tileDir := viper.GetString("tile-dir")
+		if tileDir == "" {
+			return nil, errors.New("must provide --tile-dir for dir tile source")
+		}
+		return NewDirTileStore(tileDir, "%d/%d/%d.png")
+	case TileSourceMBTiles, TileSourcePMTiles:
+		tileFile := viper.GetString("tile-file")
+		if tileFile == "" {
+			return nil, fmt.Errorf("must provide --tile-file for %s tile source", tileSource)
+		}
+		if tileSource == TileSourcePMTiles {
+			return NewPMTilesTileStore(tileFile)
+		}
+		return NewMBTilesTileStore(tileFile)
+	case TileSourceHTTP:
+		urlTempl := viper.GetString("http.url")
+		if urlTempl == "" {
+			return nil, errors.New("must provide --http-url for http tile source")
+		}
+		return NewHTTPTileStore(urlTempl,
+			viper.GetString("http.api-key"),
+			viper.GetStringMapString("http.headers"),
+			viper.GetDuration("http.timeout"),
+			viper.GetInt("http.retries"))
+	default:
+		return nil, fmt.Errorf("unsupported tile source: %s", tileSource)
+	}
+}
+
+// sourceTileStoreID identifies the upstream elevation tiles store
+// selected by the tile-source config key and its location
+func sourceTileStoreID() string {
+	tileSource := viper.GetString("tile-source")
+
+	switch tileSource {
+	case TileSourceS3:
+		return strings.Join([]string{tileSource,
+			viper.GetString("s3.endpoint"),
+			viper.GetString("s3.bucket"),
+			viper.GetString("s3.key-template")}, "|")
+	case TileSourceDir:
+		return tileSource + "|" + viper.GetString("tile-dir")
+	case TileSourceMBTiles, TileSourcePMTiles:
+		return tileSource + "|" + viper.GetString("tile-file")
+	case TileSourceHTTP:
+		return tileSource + "|" + viper.GetString("http.url")
+	default:
+		return tileSource
+	}
+}
+
+func newS3TileStore(ctx context.Context, s3Cfg s3Config) (*S3TileStore, error) {
+	if s3Cfg.bucket == "" {
+		return nil, errors.New("must provide S3 bucket")
+	}
+	if strings.Count(s3Cfg.keyTemplate, "%d") != 3 {
+		return nil, fmt.Errorf("invalid S3 key template: %s", s3Cfg.keyTemplate)
+	}
+
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(s3Cfg.region))
+	if err != nil {
+		return nil, err
+	}
+
+	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if s3Cfg.endpoint != "" {
+			o.BaseEndpoint = aws.String(s3Cfg.endpoint)
+		}
+		o.UsePathStyle = s3Cfg.pathStyle
+	})
+
+	return NewS3TileStore(s3Client, s3Cfg.bucket, s3Cfg.keyTemplate)
+}
+
+// getColorRampConfigs reads named color ramps of config key, ramp is
+// either file name or map of file, interpolation, mode, nodata and units
+func getColorRampConfigs(key string) map[string]colorRampConfig {
+	configs := make(map[string]colorRampConfig)
+	for name, v := range viper.GetStringMap(key) {
+		if file, ok := v.(string); ok {
+			configs[name] = colorRampConfig{file: file}
+			continue
+		}
+		rampKey := key + "." + name
+		configs[name] = colorRampConfig{
+			file:          viper.GetString(rampKey + ".file"),
+			interpolation: viper.GetString(rampKey + ".interpolation"),
+			mode:          viper.GetString(rampKey + ".mode"),
+			nodata:        viper.GetString(rampKey + ".nodata"),
+			units:         viper.GetString(rampKey + ".units"),
+		}
+	}
+	return configs
+}
+
+type rampStop struct {
+	Value float64 `json:"value"`
+	Color string  `json:"color"`
+}
+
+type rampInfo struct {
+	Name          string             `json:"name"`
+	Default       bool               `json:"default"`
+	Interpolation ColorInterpolation `json:"interpolation"`
+	Mode          string             `json:"mode"`
+	Nodata        string             `json:"nodata,omitempty"`
+	Units         Units              `json:"units"`
+	Stops         []rampStop         `json:"stops"`
+}
+
+// rampsHandler lists color-relief ramps with stops in request units
+func (h *terra) rampsHandler(w http.ResponseWriter, r *http.Request) {
+	units, err := h.getRequestUnits(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	names := make([]string, 0, len(h.reliefRamps))
+	for name := range h.reliefRamps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ramps := make([]rampInfo, 0, len(names))
+	for _, name := range names {
+		gm := h.reliefRamps[name]
+		info := rampInfo{
+			Name:          name,
+			Default:       name == h.defaultReliefRamp,
+			Interpolation: gm.interpolation,
+			Mode:          RampModeContinuous,
+			Units:         units,
+		}
+		if gm.discrete {
+			info.Mode = RampModeDiscrete
+		}
+		if gm.nodata.Alpha > 0 {
+			info.Nodata = gm.nodata.Hex()
+		}
+		info.Stops = rampStopsUnits(gm, units)
+		ramps = append(ramps, info)
+	}
+
+	out, err := json.Marshal(ramps)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+func (h *terra) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := map[string]CacheStats{
+		"tile_cache":      h.cacheTileStore.Stats(),
+		"elevation_cache": h.elevationTileStore.Stats(),
+	}
+	if h.diskCacheTileStore != nil {
+		stats["disk_cache"] = h.diskCacheTileStore.Stats()
+	}
+
+	out, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
 func (h *terra) tilesHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -292,27 +724,7 @@ func (h *terra) tiles512Handler(w http.ResponseWriter, r *http.Request) {
 	// 0 | 1
 	// 2 | 3
 
-	arr := make([]*bytes.Buffer, 4)
-
-	arr[0], err = h.getTile(ctx, z1, dx, dy)
-	if err != nil {
-		log.Printf("req: ERR: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	arr[1], err = h.getTile(ctx, z1, dx+1, dy)
-	if err != nil {
-		log.Printf("req: ERR: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	arr[2], err = h.getTile(ctx, z1, dx, dy+1)
-	if err != nil {
-		log.Printf("req: ERR: %v", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	arr[3], err = h.getTile(ctx, z1, dx+1, dy+1)
+	arr, err := h.getTiles(ctx, z1, []image.Point{{dx, dy}, {dx + 1, dy}, {dx, dy + 1}, {dx + 1, dy + 1}})
 	if err != nil {
 		log.Printf("req: ERR: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -406,6 +818,12 @@ func (h *terra) colorReliefHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ramp, err := h.getRequestReliefRamp(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	buf, err := h.getTile(ctx, z, x, y)
 	if err != nil {
 		log.Printf("req: ERR: %v", err)
@@ -421,7 +839,7 @@ func (h *terra) colorReliefHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	imgOut, err := ColorReliefImage(img, h.gradientMap)
+	imgOut, err := ColorReliefImage(img, h.elevationDecoder, ramp)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -448,12 +866,35 @@ func (h *terra) colorReliefHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(out)
 }
 
-func (h *terra) tilesTerrainHandler(w http.ResponseWriter, r *http.Request) {
+// getRequestReliefRamp returns color-relief ramp selected by ramp
+// query parameter or default ramp
+func (h *terra) getRequestReliefRamp(r *http.Request) (*gradientMap, error) {
+	rampName := r.URL.Query().Get("ramp")
+	if rampName == "" {
+		rampName = h.defaultReliefRamp
+	}
+	ramp, ok := h.reliefRamps[rampName]
+	if !ok {
+		return nil, fmt.Errorf("unknown color ramp: %s", rampName)
+	}
+	return ramp, nil
+}
+
+func (h *terra) terrainRGBHandler(w http.ResponseWriter, r *http.Request) {
+	h.elevationTileHandler(w, r, terrainRGBEncoding{})
+}
+
+func (h *terra) terrariumHandler(w http.ResponseWriter, r *http.Request) {
+	h.elevationTileHandler(w, r, terrariumEncoding{})
+}
+
+// elevationTileHandler serves source elevation tile re-encoded with encoder
+func (h *terra) elevationTileHandler(w http.ResponseWriter, r *http.Request, enc ElevationEncoder) {
 	ctx := r.Context()
 
 	vars := mux.Vars(r)
 
-	log.Printf("Tiles params: z=%v, x=%v, y=%v\n", vars["z"], vars["x"], vars["y"])
+	log.Printf("Elevation tile params: z=%v, x=%v, y=%v\n", vars["z"], vars["x"], vars["y"])
 
 	z, err := strconv.Atoi(vars["z"])
 	if err != nil {
@@ -471,7 +912,7 @@ func (h *terra) tilesTerrainHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	buf, err := h.getTile(ctx, z, x, y)
+	elevTile, err := h.getElevationTile(ctx, z, x, y)
 	if err != nil {
 		log.Printf("req: ERR: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -479,43 +920,103 @@ func (h *terra) tilesTerrainHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	dt1 := time.Now()
-	pixel_res, err := slippymath.TilePixelResolution(uint32(z), float64(x), float64(y))
+
+	elevData := make([]float64, len(elevTile))
+	for idx, v := range elevTile {
+		elevData[idx] = float64(v)
+	}
+
+	imgOut, err := enc.EncodeElevation(elevData, TileSize, TileSize)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	img, _, err := image.Decode(bytes.NewReader(buf.Bytes()))
+	buf := new(bytes.Buffer)
+	err = png.Encode(buf, imgOut)
 	if err != nil {
-		h.clearTileCache(ctx, z, x, y)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	h_factor := 1.0
-	altitude := 45.0
-	azimuth := 315.0
+	dt2 := time.Now()
+	log.Printf("Elevation tile encoded in %v", dt2.Sub(dt1))
 
-	var imgOut image.Image
-	imgOut, err = HillshadeImage(img, pixel_res, h_factor, altitude, azimuth)
+	out := buf.Bytes()
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "max-age:28800, public")
+	cacheSince := time.Now().Format(http.TimeFormat)
+	cacheUntil := time.Now().Add(8 * time.Hour).Format(http.TimeFormat)
+	w.Header().Set("Last-Modified", cacheSince)
+	w.Header().Set("Expires", cacheUntil)
+
+	w.Write(out)
+}
+
+func (h *terra) tilesTerrainHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	vars := mux.Vars(r)
+
+	log.Printf("Tiles params: z=%v, x=%v, y=%v\n", vars["z"], vars["x"], vars["y"])
+
+	z, err := strconv.Atoi(vars["z"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	x, err := strconv.Atoi(vars["x"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	y, err := strconv.Atoi(vars["y"])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var tr string
-	transp, ok := r.URL.Query()["transp"]
-	if ok {
-		tr = transp[0]
+	params, err := getRequestHillshadeParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// one pixel border from neighbour tiles for continuous shading at edges
+	const border = 1
+	elevData, winWidth, winHeight, err := h.getElevationWindow(ctx, z, x, y, border)
+	if err != nil {
+		log.Printf("req: ERR: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dt1 := time.Now()
+	pixel_res, err := slippymath.TilePixelResolution(uint32(z), float64(x), float64(y))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var imgOut image.Image
+	imgOut, err = HillshadeElevation(elevData, winWidth, winHeight, border, pixel_res,
+		params.zFactor, params.altitude, params.azimuth, params.shading)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if tr == "1" {
+	switch params.mode {
+	case HillshadeModeTransparent:
 		imgOut = TransparentGrayscale(imgOut)
+	case HillshadeModeInverted:
+		imgOut = InvertGrayscale(imgOut)
 	}
 	dt2 := time.Now()
 	log.Printf("Hillshade completed in %v", dt2.Sub(dt1))
 
-	buf = new(bytes.Buffer)
+	buf := new(bytes.Buffer)
 	err = png.Encode(buf, imgOut)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -537,105 +1038,58 @@ func (h *terra) tilesTerrainHandler(w http.ResponseWriter, r *http.Request) {
 func (h *terra) tilesContoursHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	vars, outFormat, interval, lvlInterval, zoom, tile_X, tile_Y, shouldReturn := h.getRequestContourParams(r, w)
-	if shouldReturn {
+	params, err := h.getRequestContourParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	zoom, tile_X, tile_Y, lvlInterval := params.zoom, params.tile_X, params.tile_Y, params.interval
 
-	log.Printf("Contours params: z=%v, x=%v, y=%v, interval=%s\n",
-		vars["z"], vars["x"], vars["y"], interval)
-
-	oName := fmt.Sprintf("v2/terrarium/%d/%d/%d.png", zoom, tile_X, tile_Y)
+	major, err := getRequestMajor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	split := r.URL.Query().Get("split") == "1"
 
-	// request surrounding tiles
+	log.Printf("Contours params: z=%v, x=%v, y=%v, interval=%v%s, major=%d\n",
+		zoom, tile_X, tile_Y, lvlInterval, params.units, major)
 
-	steps := [9][2]int{{-1, -1}, {0, -1}, {1, -1}, {-1, 0}, {0, 0}, {1, 0}, {-1, 1}, {0, 1}, {1, 1}}
+	oName := fmt.Sprintf(tileKeyTempl, zoom, tile_X, tile_Y)
 
 	dtStart := time.Now()
 
-	dt1 := time.Now()
-
-	data := make([]float64, 9*TileSize*TileSize)
-
-	for idx := 0; idx < 9; idx++ {
-
-		elevTile, err := h.getElevationTile(ctx, zoom, tile_X+steps[idx][0], tile_Y+steps[idx][1])
-		if err != nil {
-			log.Printf("req: %s, ERR: %v", oName, err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		for y := 0; y < TileSize; y++ {
-			for x := 0; x < TileSize; x++ {
-				h := elevTile[y*TileSize+x]
-
-				idxH := 0
-				if idx == 0 {
-					idxH = x + y*3*TileSize
-				}
-				if idx == 1 {
-					idxH = x + TileSize + y*3*TileSize
-				}
-				if idx == 2 {
-					idxH = x + 2*TileSize + y*3*TileSize
-				}
-				if idx == 3 {
-					idxH = x + (y+TileSize)*3*TileSize
-				}
-				if idx == 4 {
-					idxH = (x + TileSize) + (y+TileSize)*3*TileSize
-				}
-				if idx == 5 {
-					idxH = (x + 2*TileSize) + (y+TileSize)*3*TileSize
-				}
-				if idx == 6 {
-					idxH = (x) + (y+2*TileSize)*3*TileSize
-				}
-				if idx == 7 {
-					idxH = (x + TileSize) + (y+2*TileSize)*3*TileSize
-				}
-				if idx == 8 {
-					idxH = (x + 2*TileSize) + (y+2*TileSize)*3*TileSize
-				}
-
-				data[idxH] = h
-			}
-		}
-	}
-
-	dt2 := time.Now()
-	log.Printf("decoded images %v\n", dt2.Sub(dt1))
-
 	const off_px = 3
 
-	width := TileSize + 2*off_px
-	height := TileSize + 2*off_px
-
-	windowedData := make([]float64, width*height)
-
-	startX := TileSize - off_px
-	startY := TileSize - off_px
-
-	w_idx := 0
-	for dt_y := 0; dt_y < height; dt_y++ {
-		for dt_x := 0; dt_x < width; dt_x++ {
-			dt_idx := (startY+dt_y)*3*TileSize + dt_x + startX
-			windowedData[w_idx] = data[dt_idx]
-			w_idx++
-		}
+	windowedData, width, height, err := h.getElevationWindowUnits(ctx, params.units, zoom, tile_X, tile_Y, off_px)
+	if err != nil {
+		log.Printf("req: %s, ERR: %v", oName, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
+	dt1 := time.Now()
+	log.Printf("decoded images %v\n", dt1.Sub(dtStart))
+
 	m := contourmap.FromFloat64s(width, height, windowedData)
 
 	z0 := m.Min
 	z1 := m.Max
+	if (z1-z0)/lvlInterval > maxContourLevels {
+		http.Error(w, fmt.Sprintf("interval %v is too small for elevation range of the tile", lvlInterval), http.StatusBadRequest)
+		return
+	}
 
 	zLevel := math.Ceil(z0/lvlInterval) * lvlInterval
 
 	fc := geojson.NewFeatureCollection()
+	fcIndex := fc
+	if split {
+		fcIndex = geojson.NewFeatureCollection()
+	}
 
 	for zLevel <= z1 {
+		index := isIndexContour(zLevel, lvlInterval, major)
 		contours := m.Contours(zLevel)
 		for _, contour := range contours {
 			ls := make(orb.LineString, len(contour))
@@ -655,64 +1109,55 @@ func (h *terra) tilesContoursHandler(w http.ResponseWriter, r *http.Request) {
 			}
 			feat := geojson.NewFeature(ls)
 			feat.Properties["elevation"] = zLevel
-			fc.Append(feat)
+			feat.Properties["index"] = index
+			if index {
+				fcIndex.Append(feat)
+			} else {
+				fc.Append(feat)
+			}
 		}
 		zLevel += lvlInterval
 	}
 
-	var out []byte
-	var err error
-
-	if outFormat == FeatureOutGeoJSON {
-		out, err = fc.MarshalJSON()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-	} else if outFormat == FeatureOutMVT {
-
-		colMvt := make(map[string]*geojson.FeatureCollection)
-		colMvt["contours"] = fc
-
-		// Convert to a layers object and project to tile coordinates.
-		layers := mvt.NewLayers(colMvt)
-		layers.ProjectToTile(maptile.New(uint32(tile_X), uint32(tile_Y), maptile.Zoom(zoom)))
-
-		layers.Simplify(simplify.DouglasPeucker(1.0))
-
-		// Depending on use-case remove empty geometry, those too small to be
-		// represented in this tile space.
-		// In this case lines shorter than 1, and areas smaller than 2.
-		layers.RemoveEmpty(1.0, 2.0)
-
-		// encoding using the Mapbox Vector Tile protobuf encoding.
-		out, err = mvt.Marshal(layers) // this data is NOT gzipped.
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	colMvt := map[string]*geojson.FeatureCollection{"contours": fc}
+	if split {
+		colMvt["contours_index"] = fcIndex
+	}
 
-		w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	out, contentType, err := encodeFeatureLayers(colMvt, params.outFormat, zoom, tile_X, tile_Y)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	w.Header().Set("Content-Type", contentType)
 
-	dt2 = time.Now()
+	dt2 := time.Now()
 	log.Printf("Contour completed in %v\n", dt2.Sub(dtStart))
 
 	w.Write(out)
 }
 
+// Close flushes persistent cache
+func (h *terra) Close() error {
+	if h.diskCacheTileStore != nil {
+		return h.diskCacheTileStore.Close()
+	}
+	return nil
+}
+
 func (h *terra) clearTileCache(ctx context.Context, zoom int, tile_X int, tile_Y int) {
 
 	h.cacheTileStore.ClearTile(ctx, uint32(zoom), uint32(tile_X), uint32(tile_Y))
+	if h.diskCacheTileStore != nil {
+		h.diskCacheTileStore.ClearTile(ctx, uint32(zoom), uint32(tile_X), uint32(tile_Y))
+	}
 }
 
 func (h *terra) getTile(ctx context.Context, zoom int, tile_X int, tile_Y int) (*bytes.Buffer, error) {
 	cacheData, err := h.cacheTileStore.GetTile(ctx, uint32(zoom), uint32(tile_X), uint32(tile_Y))
 
 	var tile *bytes.Buffer
-	oName := fmt.Sprintf("v2/terrarium/%d/%d/%d.png", zoom, tile_X, tile_Y)
+	oName := fmt.Sprintf(tileKeyTempl, zoom, tile_X, tile_Y)
 	dt1 := time.Now()
 
 	if err == nil {
@@ -722,26 +1167,82 @@ func (h *terra) getTile(ctx context.Context, zoom int, tile_X int, tile_Y int) (
 		log.Printf("Cache hit: %s, read: %d in %v", oName, tile.Len(), dt2.Sub(dt1))
 	} else if err == ErrTileNotFound {
 
-		s3Data, err := h.s3TileStore.GetTile(ctx, uint32(zoom), uint32(tile_X), uint32(tile_Y))
+		// concurrent requests of the same missing tile wait for single fetch
+		res, shared, err := doShared(ctx, &h.tileGroup, oName, func(ctx context.Context) (interface{}, error) {
+			srcData, src, err := h.getUncachedTile(ctx, zoom, tile_X, tile_Y)
+			if err != nil {
+				return nil, err
+			}
+
+			cacheData := make([]byte, len(srcData))
+			copy(cacheData, srcData)
+			h.cacheTileStore.Add(uint32(zoom), uint32(tile_X), uint32(tile_Y), cacheData)
+
+			dt2 := time.Now()
+			log.Printf("%s GetTile: %s, read: %d in %v", src, oName, len(cacheData), dt2.Sub(dt1))
+
+			return cacheData, nil
+		})
 		if err != nil {
 			return nil, err
 		}
+		if shared {
+			log.Printf("Shared GetTile: %s", oName)
+		}
 
-		tile = bytes.NewBuffer(s3Data)
-
-		cacheData := make([]byte, tile.Len())
-		copy(cacheData, tile.Bytes())
-		h.cacheTileStore.Add(uint32(zoom), uint32(tile_X), uint32(tile_Y), cacheData)
-
-		dt2 := time.Now()
-		log.Printf("S3 GetObject: %s, read: %d in %v", oName, len(cacheData), dt2.Sub(dt1))
+		tile = bytes.NewBuffer(res.([]byte))
 	} else {
 		return nil, err
 	}
 	return tile, nil
 }
 
-func (h *terra) getElevationTile(ctx context.Context, zoom int, tile_X int, tile_Y int) ([]float64, error) {
+// doShared runs fn once for concurrent callers of the same key. fn runs on
+// context detached from callers with its own timeout, so a cancelled caller
+// does not fail others waiting for the result, each caller stops waiting
+// when its own ctx is done
+func doShared(ctx context.Context, group *singleflight.Group, key string,
+	fn func(ctx context.Context) (interface{}, error)) (interface{}, bool, error) {
+
+	ch := group.DoChan(key, func() (interface{}, error) {
+		sharedCtx, cancel := context.WithTimeout(context.Background(), sharedFetchTimeout)
+		defer cancel()
+		return fn(sharedCtx)
+	})
+
+	select {
+	case res := <-ch:
+		return res.Val, res.Shared, res.Err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+// getUncachedTile reads tile from disk cache if enabled or from the source,
+// returns tile data and name of the store it was read from
+func (h *terra) getUncachedTile(ctx context.Context, zoom int, tile_X int, tile_Y int) ([]byte, string, error) {
+	if h.diskCacheTileStore != nil {
+		diskData, err := h.diskCacheTileStore.GetTile(ctx, uint32(zoom), uint32(tile_X), uint32(tile_Y))
+		if err == nil {
+			return diskData, "Disk cache", nil
+		} else if err != ErrTileNotFound {
+			log.Printf("disk cache: ERR: %v", err)
+		}
+	}
+
+	srcData, err := h.tileStore.GetTile(ctx, uint32(zoom), uint32(tile_X), uint32(tile_Y))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if h.diskCacheTileStore != nil {
+		h.diskCacheTileStore.Add(uint32(zoom), uint32(tile_X), uint32(tile_Y), srcData)
+	}
+
+	return srcData, "Source", nil
+}
+
+func (h *terra) getElevationTile(ctx context.Context, zoom int, tile_X int, tile_Y int) ([]float32, error) {
 	dt1 := time.Now()
 
 	elevData, err := h.elevationTileStore.GetTile(ctx, uint32(zoom), uint32(tile_X), uint32(tile_Y))
@@ -754,119 +1255,370 @@ func (h *terra) getElevationTile(ctx context.Context, zoom int, tile_X int, tile
 		return nil, err
 	}
 
-	dt1 = time.Now()
+	// concurrent requests of the same missing tile wait for single decode,
+	// decoded data is shared and must not be modified
+	oName := fmt.Sprintf(tileKeyTempl, zoom, tile_X, tile_Y)
+	res, _, err := doShared(ctx, &h.elevationGroup, oName, func(ctx context.Context) (interface{}, error) {
+		dt1 := time.Now()
 
-	tile, err := h.getTile(ctx, zoom, tile_X, tile_Y)
+		tile, err := h.getTile(ctx, zoom, tile_X, tile_Y)
+		if err != nil {
+			return nil, err
+		}
+
+		img, _, err := image.Decode(bytes.NewReader(tile.Bytes()))
+		if err != nil {
+			// drop broken tile, so next request fetches it again
+			h.clearTileCache(ctx, zoom, tile_X, tile_Y)
+			return nil, err
+		}
+
+		if img.Bounds().Dx() != TileSize || img.Bounds().Dy() != TileSize {
+			return nil, fmt.Errorf("elevation tile %d_%d_%d: unexpected size %v", zoom, tile_X, tile_Y, img.Bounds().Size())
+		}
+
+		decoded, err := h.elevationDecoder.DecodeElevation(img)
+		if err != nil {
+			return nil, err
+		}
+
+		data := make([]float32, len(decoded))
+		for idx, v := range decoded {
+			data[idx] = float32(v)
+		}
+		h.elevationTileStore.Add(uint32(zoom), uint32(tile_X), uint32(tile_Y), data)
+
+		dt2 := time.Now()
+		log.Printf("Elevation tile: %d_%d_%d, decode elevation data in %v", zoom, tile_X, tile_Y, dt2.Sub(dt1))
+
+		return data, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	data := make([]float64, TileSize*TileSize)
-	img, _, err := image.Decode(bytes.NewReader(tile.Bytes()))
-	if err != nil {
-		return nil, err
+	return res.([]float32), nil
+}
+
+type hillshadeParams struct {
+	azimuth  float64
+	altitude float64
+	zFactor  float64
+	mode     string
+	shading  HillshadeShading
+}
+
+// getRequestHillshadeParams reads hillshade query parameters:
+// azimuth (0-360, default 315), altitude (0-90, default 45),
+// zfactor (default 1), mode (gray, transparent, inverted) and
+// shading (standard, multidirectional, combined).
+// Legacy transp=1 selects transparent mode.
+func getRequestHillshadeParams(r *http.Request) (hillshadeParams, error) {
+	params := hillshadeParams{
+		azimuth:  315.0,
+		altitude: 45.0,
+		zFactor:  1.0,
+		mode:     HillshadeModeGray,
+		shading:  HillshadeShadingStandard,
+	}
+
+	query := r.URL.Query()
+
+	floatParams := []struct {
+		name     string
+		value    *float64
+		min, max float64
+	}{
+		{"azimuth", &params.azimuth, 0, 360},
+		{"altitude", &params.altitude, 0, 90},
+		{"zfactor", &params.zFactor, epsilon, 1000},
+	}
+	for _, p := range floatParams {
+		v := query.Get(p.name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || f < p.min || f > p.max {
+			return params, fmt.Errorf("invalid %s: %s, expected value in range %v-%v", p.name, v, p.min, p.max)
+		}
+		*p.value = f
+	}
+
+	if query.Get("transp") == "1" {
+		params.mode = HillshadeModeTransparent
+	}
+	if mode := query.Get("mode"); mode != "" {
+		switch mode {
+		case HillshadeModeGray, HillshadeModeTransparent, HillshadeModeInverted:
+			params.mode = mode
+		default:
+			return params, fmt.Errorf("unsupported hillshade mode: %s", mode)
+		}
+	}
+
+	if shading := query.Get("shading"); shading != "" {
+		switch HillshadeShading(shading) {
+		case HillshadeShadingStandard, HillshadeShadingMultidirectional, HillshadeShadingCombined:
+			params.shading = HillshadeShading(shading)
+		default:
+			return params, fmt.Errorf("unsupported hillshade shading: %s", shading)
+		}
 	}
 
-	bounds := img.Bounds()
-	rgba := image.NewRGBA(bounds)
-	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	return params, nil
+}
+
+// getRequestMajor reads major query parameter, every major-th contour
+// level is index contour (default 5)
+func getRequestMajor(r *http.Request) (int, error) {
+	major := 5
+	if v := r.URL.Query().Get("major"); v != "" {
+		var err error
+		major, err = strconv.Atoi(v)
+		if err != nil || major < 1 {
+			return 0, fmt.Errorf("invalid major: %s, expected positive integer", v)
+		}
+	}
+	return major, nil
+}
 
-	idx := 0
-	for y := 0; y < TileSize; y++ {
-		for x := 0; x < TileSize; x++ {
-			pix_idx := (y*TileSize + x) * 4
-			pix := rgba.Pix[pix_idx : pix_idx+4]
-			dr := uint32(pix[0])
-			dg := uint32(pix[1])
-			db := uint32(pix[2])
-			da := uint32(pix[3])
-			h := rgbaToHeight(dr, dg, db, da)
+// isIndexContour reports whether level is multiple of major intervals
+func isIndexContour(level float64, interval float64, major int) bool {
+	n := level / (interval * float64(major))
+	return math.Abs(n-math.Round(n)) < epsilon
+}
 
-			data[idx] = h
-			idx++
+// encodeFeatureLayers encodes named layers of features in lon/lat as
+// GeoJSON (features of all layers) or MVT of the tile, returns tile data
+// and its content type. Exterior rings of polygons are counter-clockwise
+// in output coordinates.
+func encodeFeatureLayers(colMvt map[string]*geojson.FeatureCollection,
+	outFormat FeatureOutFormat,
+	zoom int,
+	tile_X int,
+	tile_Y int) ([]byte, string, error) {
+
+	if outFormat == FeatureOutGeoJSON {
+		names := make([]string, 0, len(colMvt))
+		for name := range colMvt {
+			names = append(names, name)
 		}
+		sort.Strings(names)
+
+		fc := geojson.NewFeatureCollection()
+		for _, name := range names {
+			for _, feat := range colMvt[name].Features {
+				feat.Geometry = orientPolygons(feat.Geometry)
+				fc.Append(feat)
+			}
+		}
+
+		out, err := fc.MarshalJSON()
+		if err != nil {
+			return nil, "", err
+		}
+		return out, "application/json", nil
 	}
 
-	h.elevationTileStore.Add(uint32(zoom), uint32(tile_X), uint32(tile_Y), data)
+	// Convert to a layers object and project to tile coordinates.
+	layers := mvt.NewLayers(colMvt)
+	layers.ProjectToTile(maptile.New(uint32(tile_X), uint32(tile_Y), maptile.Zoom(zoom)))
 
-	dt2 := time.Now()
-	log.Printf("Elevation tile: %d_%d_%d, decode elevation data in %v", zoom, tile_X, tile_Y, dt2.Sub(dt1))
+	layers.Simplify(simplify.DouglasPeucker(1.0))
 
-	return data, nil
+	// Depending on use-case remove empty geometry, those too small to be
+	// represented in this tile space.
+	// In this case lines shorter than 1, and areas smaller than 2.
+	layers.RemoveEmpty(1.0, 2.0)
+
+	// tile y axis points down, so exterior rings are clockwise on screen
+	// as required by MVT spec
+	for _, layer := range layers {
+		for _, feat := range layer.Features {
+			feat.Geometry = orientPolygons(feat.Geometry)
+		}
+	}
+
+	// encoding using the Mapbox Vector Tile protobuf encoding.
+	out, err := mvt.Marshal(layers) // this data is NOT gzipped.
+	if err != nil {
+		return nil, "", err
+	}
+	return out, "application/vnd.mapbox-vector-tile", nil
 }
 
-func (*terra) getRequestContourParams(r *http.Request, w http.ResponseWriter) (map[string]string, FeatureOutFormat, string, float64, int, int, int, bool) {
+// orientPolygons makes exterior rings of polygons counter-clockwise
+// and inner rings clockwise, other geometries are returned as is
+func orientPolygons(g orb.Geometry) orb.Geometry {
+	orient := func(p orb.Polygon) {
+		for idx, ring := range p {
+			want := orb.CCW
+			if idx > 0 {
+				want = orb.CW
+			}
+			if ring.Orientation() == -want {
+				ring.Reverse()
+			}
+		}
+	}
+
+	switch g := g.(type) {
+	case orb.Polygon:
+		orient(g)
+	case orb.MultiPolygon:
+		for _, p := range g {
+			orient(p)
+		}
+	}
+	return g
+}
+
+// contourParams are request parameters of contour and isoband tiles
+type contourParams struct {
+	outFormat FeatureOutFormat
+	interval  float64
+	units     Units
+	zoom      int
+	tile_X    int
+	tile_Y    int
+}
+
+// zoomInterval is default contour interval from zoom level up
+type zoomInterval struct {
+	zoom     int
+	interval float64
+}
+
+// defaultContourIntervals are default contour intervals of units by zoom level
+var defaultContourIntervals = map[Units][]zoomInterval{
+	UnitsMeters: {{0, 500}, {10, 200}, {11, 100}, {12, 50}, {13, 20}, {15, 10}, {16, 5}},
+	UnitsFeet:   {{0, 2000}, {10, 500}, {11, 250}, {12, 200}, {13, 50}, {15, 25}, {16, 10}},
+}
+
+// maxContourLevels limits number of contour levels of a tile
+const maxContourLevels = 1000
+
+// parseContourIntervals parses zoom to interval table
+func parseContourIntervals(m map[string]string) ([]zoomInterval, error) {
+	if len(m) == 0 {
+		return nil, errors.New("empty contour interval table")
+	}
+	table := make([]zoomInterval, 0, len(m))
+	for z, v := range m {
+		zoom, err := strconv.Atoi(z)
+		if err != nil || zoom < 0 {
+			return nil, fmt.Errorf("invalid zoom: %s", z)
+		}
+		interval, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(interval > 0) || math.IsInf(interval, 0) {
+			return nil, fmt.Errorf("invalid interval of zoom %d: %s", zoom, v)
+		}
+		table = append(table, zoomInterval{zoom, interval})
+	}
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].zoom < table[j].zoom
+	})
+	return table, nil
+}
+
+// contourInterval returns interval of the highest table zoom not above
+// zoom, zooms below the table use its first interval
+func contourInterval(table []zoomInterval, zoom int) float64 {
+	interval := table[0].interval
+	for _, zi := range table {
+		if zi.zoom > zoom {
+			break
+		}
+		interval = zi.interval
+	}
+	return interval
+}
+
+// getRequestContourParams reads tile coordinates and output format, and
+// interval (default by zoom level) in request units
+func (h *terra) getRequestContourParams(r *http.Request) (contourParams, error) {
+	var params contourParams
 	vars := mux.Vars(r)
 
-	outFormat := FeatureOutFormat(vars["format"])
-	switch outFormat {
+	params.outFormat = FeatureOutFormat(vars["format"])
+	switch params.outFormat {
 	case FeatureOutGeoJSON, FeatureOutMVT:
 	default:
-		err := errors.New("unsupported output format")
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return nil, "", "", 0, 0, 0, 0, true
+		return params, errors.New("unsupported output format")
 	}
 
-	interval := "100"
-	intervals, ok := r.URL.Query()["interval"]
-	if ok {
-		interval = intervals[0]
-	}
-	iLvl, err := strconv.Atoi(interval)
+	var err error
+	params.zoom, err = strconv.Atoi(vars["z"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return nil, "", "", 0, 0, 0, 0, true
+		return params, err
 	}
-	lvlInterval := float64(iLvl)
-
-	zoom, err := strconv.Atoi(vars["z"])
+	params.tile_X, err = strconv.Atoi(vars["x"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return nil, "", "", 0, 0, 0, 0, true
+		return params, err
 	}
-	tile_X, err := strconv.Atoi(vars["x"])
+	params.tile_Y, err = strconv.Atoi(vars["y"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return nil, "", "", 0, 0, 0, 0, true
+		return params, err
 	}
-	tile_Y, err := strconv.Atoi(vars["y"])
+
+	params.units, err = h.getRequestUnits(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return nil, "", "", 0, 0, 0, 0, true
+		return params, err
 	}
-	return vars, outFormat, interval, lvlInterval, zoom, tile_X, tile_Y, false
-}
 
-func rgbaToHeight(r uint32, g uint32, b uint32, a uint32) float64 {
-
-	r &= 0xff
-	g &= 0xff
-	b &= 0xff
+	params.interval = contourInterval(h.contourIntervals[params.units], params.zoom)
+	if v := r.URL.Query().Get("interval"); v != "" {
+		params.interval, err = strconv.ParseFloat(v, 64)
+		if err != nil || !(params.interval > 0) || math.IsInf(params.interval, 0) {
+			return params, fmt.Errorf("invalid interval: %s", v)
+		}
+	}
 
-	// (red * 256 + green + blue / 256) - 32768
-	h := float64(r*256 + g)
-	h += float64(b) / 256
-	h -= 32768
-	return h
+	return params, nil
 }
 
 type HeightColor struct {
 	Col    colorful.Color
 	Height float64
+	Alpha  float64
+}
+
+// Hex returns color as #rrggbb, or #rrggbbaa if not opaque
+func (hc HeightColor) Hex() string {
+	if hc.Alpha >= 1 {
+		return hc.Col.Hex()
+	}
+	return fmt.Sprintf("%s%02x", hc.Col.Hex(), uint8(math.Round(hc.Alpha*255)))
+}
+
+// NRGBA converts color with its alpha
+func (hc HeightColor) NRGBA() color.NRGBA {
+	r, g, b, _ := hc.Col.RGBA()
+	return color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(math.Round(hc.Alpha * 255))}
 }
 
 type GradientTable []HeightColor
 
 type gradientMap struct {
-	heighColors    map[float64]colorful.Color
+	heighColors    map[float64]HeightColor
 	heighPrecision float64
 	minColor       HeightColor
 	maxColor       HeightColor
 	gradients      GradientTable
+	colorCard      []colorCard
+
+	// interpolation is color space of blending between stops
+	interpolation ColorInterpolation
+	// discrete maps values to color of class break at or below them
+	discrete bool
+	// nodata is color of NaN values
+	nodata HeightColor
 
 	lock sync.RWMutex
 }
 
+// colorCard is color stop, colorHex is #rrggbb or #rrggbbaa
 type colorCard struct {
 	height   float64
 	colorHex string
@@ -878,38 +1630,51 @@ func NewGradientMap(colorCard []colorCard, heighPrecision float64) (*gradientMap
 	}
 
 	gm := gradientMap{
-		heighColors:    make(map[float64]colorful.Color),
+		heighColors:    make(map[float64]HeightColor),
 		heighPrecision: heighPrecision,
 		gradients:      make(GradientTable, 0),
+		colorCard:      colorCard,
+		interpolation:  InterpolationRGB,
 	}
 
-	gm.minColor = HeightColor{
-		Height: colorCard[0].height,
-		Col:    MustParseHex(colorCard[0].colorHex),
-	}
-	gm.maxColor = HeightColor{
-		Height: colorCard[len(colorCard)-1].height,
-		Col:    MustParseHex(colorCard[len(colorCard)-1].colorHex),
-	}
-
-	for idx := 1; idx < len(colorCard); idx++ {
+	for idx := 0; idx < len(colorCard); idx++ {
+		col, alpha, err := ParseHexAlpha(colorCard[idx].colorHex)
+		if err != nil {
+			return nil, err
+		}
 		gm.gradients = append(gm.gradients,
 			HeightColor{
-				MustParseHex(colorCard[idx].colorHex),
-				colorCard[idx].height,
+				Col:    col,
+				Height: colorCard[idx].height,
+				Alpha:  alpha,
 			})
 	}
 
+	gm.minColor = gm.gradients[0]
+	gm.maxColor = gm.gradients[len(gm.gradients)-1]
+
 	return &gm, nil
 }
 
 func (gm *gradientMap) HeightToColor(h float64) colorful.Color {
+	return gm.heightColor(h).Col
+}
+
+func (gm *gradientMap) heightColor(h float64) HeightColor {
 
 	if h <= gm.minColor.Height {
-		return gm.minColor.Col
+		return gm.minColor
 	}
 	if h >= gm.maxColor.Height {
-		return gm.maxColor.Col
+		return gm.maxColor
+	}
+
+	if gm.discrete {
+		// first stop above h, class break equal to h starts its class
+		idx := sort.Search(len(gm.gradients), func(i int) bool {
+			return gm.gradients[i].Height > h
+		})
+		return gm.gradients[idx-1]
 	}
 
 	hPos := math.Round(h/gm.heighPrecision) * gm.heighPrecision
@@ -924,11 +1689,14 @@ func (gm *gradientMap) HeightToColor(h float64) colorful.Color {
 	for i := 0; i < len(gm.gradients)-1; i++ {
 		c1 := gm.gradients[i]
 		c2 := gm.gradients[i+1]
-		if c1.Height <= h && h <= c2.Height {
+		if c1.Height <= h && h <= c2.Height && c1.Height < c2.Height {
 			// We are in between c1 and c2. Go blend them!
 			hBlend := (h - c1.Height) / (c2.Height - c1.Height)
-			//hCol := c1.Col.BlendHcl(c2.Col, hBlend).Clamped()
-			hCol := c1.Col.BlendRgb(c2.Col, hBlend).Clamped()
+			hCol := HeightColor{
+				Col:    gm.interpolation.blend(c1.Col, c2.Col, hBlend).Clamped(),
+				Height: hPos,
+				Alpha:  c1.Alpha + hBlend*(c2.Alpha-c1.Alpha),
+			}
 
 			gm.lock.Lock()
 			gm.heighColors[hPos] = hCol
@@ -938,7 +1706,7 @@ func (gm *gradientMap) HeightToColor(h float64) colorful.Color {
 		}
 	}
 
-	return gm.maxColor.Col
+	return gm.maxColor
 }
 
 func MustParseHex(s string) colorful.Color {
@@ -948,3 +1716,17 @@ func MustParseHex(s string) colorful.Color {
 	}
 	return c
 }
+
+// ParseHexAlpha parses #rrggbb or #rrggbbaa color
+func ParseHexAlpha(s string) (colorful.Color, float64, error) {
+	if len(s) != 9 {
+		c, err := colorful.Hex(s)
+		return c, 1, err
+	}
+	a, err := strconv.ParseUint(s[7:], 16, 8)
+	if err != nil {
+		return colorful.Color{}, 0, fmt.Errorf("color: %v is not a hex-color", s)
+	}
+	c, err := colorful.Hex(s[:7])
+	return c, float64(a) / 255, err
+}
@@ -2,12 +2,18 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"image"
 	"image/png"
 	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,6 +24,7 @@ import (
 
 	"github.com/fogleman/contourmap"
 	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
 	"github.com/paulmach/orb/geojson"
 )
 
@@ -626,9 +633,443 @@ func Test_hillshade_1(t *testing.T) {
 	h_factor := 1.0
 	altitude := 45.0
 	azimuth := 315.0
-	imgOut, err := HillshadeImage(img, pixel_res, h_factor, altitude, azimuth)
+	imgOut, err := HillshadeImage(img, terrariumEncoding{}, pixel_res, h_factor, altitude, azimuth)
 	require.NoError(t, err)
 
 	f, _ := os.Create("image_out.png")
 	png.Encode(f, imgOut)
 }
+
+// newTestTerra creates terra serving elevation tiles from test_data directory
+func newTestTerra(t *testing.T) *terra {
+	tileStore, err := NewDirTileStore("./test_data", "terrarium_%d_%d_%d.png")
+	require.NoError(t, err)
+
+	h, err := NewTerra(tileStore, terrariumEncoding{}, defaultTileCacheSize, defaultElevationCacheSize)
+	require.NoError(t, err)
+
+	return h
+}
+
+func Test_terrainRGBHandler_1(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/terrain-rgb/14/11583/6049.png", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+
+	img, err := png.Decode(rec.Body)
+	require.NoError(t, err)
+
+	data, err := terrainRGBEncoding{}.DecodeElevation(img)
+	require.NoError(t, err)
+
+	elevData, err := h.getElevationTile(context.Background(), 14, 11583, 6049)
+	require.NoError(t, err)
+
+	for idx := range elevData {
+		require.InDelta(t, elevData[idx], data[idx], 0.05+epsilon)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/terrain-rgb/14/1/1.png", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// slowTileStore counts source requests, delay makes concurrent requests overlap
+type slowTileStore struct {
+	TileStore
+	delay    time.Duration
+	requests int32
+}
+
+func (ts *slowTileStore) GetTile(ctx context.Context, z uint32, x uint32, y uint32) ([]byte, error) {
+	atomic.AddInt32(&ts.requests, 1)
+	select {
+	case <-time.After(ts.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return ts.TileStore.GetTile(ctx, z, x, y)
+}
+
+func Test_getElevationTile_coalescing(t *testing.T) {
+	dirTileStore, err := NewDirTileStore("./test_data", "terrarium_%d_%d_%d.png")
+	require.NoError(t, err)
+
+	tileStore := &slowTileStore{TileStore: dirTileStore, delay: 100 * time.Millisecond}
+	h, err := NewTerra(tileStore, terrariumEncoding{}, defaultTileCacheSize, defaultElevationCacheSize)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				_, errs[i] = h.getElevationTile(context.Background(), 14, 11583, 6049)
+			} else {
+				_, errs[i] = h.getTile(context.Background(), 14, 11583, 6049)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tileStore.requests))
+}
+
+func Test_getElevationTile_cancelledLeader(t *testing.T) {
+	dirTileStore, err := NewDirTileStore("./test_data", "terrarium_%d_%d_%d.png")
+	require.NoError(t, err)
+
+	tileStore := &slowTileStore{TileStore: dirTileStore, delay: 200 * time.Millisecond}
+	h, err := NewTerra(tileStore, terrariumEncoding{}, defaultTileCacheSize, defaultElevationCacheSize)
+	require.NoError(t, err)
+
+	// leader starts the fetch and gives up waiting
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := h.getElevationTile(leaderCtx, 14, 11583, 6049)
+		leaderErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	followerErr := make(chan error, 1)
+	go func() {
+		_, err := h.getElevationTile(context.Background(), 14, 11583, 6049)
+		followerErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	assert.ErrorIs(t, <-leaderErr, context.Canceled)
+	// shared fetch is not cancelled with the leader
+	require.NoError(t, <-followerErr)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tileStore.requests))
+}
+
+func Test_HillshadeElevation_seamless(t *testing.T) {
+	h := newTestTerra(t)
+	ctx := context.Background()
+
+	pixel_res, err := slippymath.TilePixelResolution(14, 11583, 6049)
+	require.NoError(t, err)
+
+	data, width, height, err := h.getElevationWindow(ctx, 14, 11583, 6049, 1)
+	require.NoError(t, err)
+	imgTile, err := HillshadeElevation(data, width, height, 1, pixel_res, 1.0, 45, 315, HillshadeShadingStandard)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, TileSize, TileSize), imgTile.Bounds())
+
+	// hillshade of 3x3 tiles mosaic cropped to the center tile
+	data, width, height, err = h.getElevationWindow(ctx, 14, 11583, 6049, TileSize)
+	require.NoError(t, err)
+	imgMosaic, err := HillshadeElevation(data, width, height, 1, pixel_res, 1.0, 45, 315, HillshadeShadingStandard)
+	require.NoError(t, err)
+
+	for y := 0; y < TileSize; y++ {
+		for x := 0; x < TileSize; x++ {
+			require.Equal(t, imgMosaic.At(x+TileSize-1, y+TileSize-1), imgTile.At(x, y), "pixel %d,%d", x, y)
+		}
+	}
+
+	_, err = HillshadeElevation(data, width, height, 0, pixel_res, 1.0, 45, 315, HillshadeShadingStandard)
+	assert.Error(t, err)
+}
+
+func Test_tilesTerrainHandler_params(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	getImage := func(query string) image.Image {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/terrain/14/11583/6049.img"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		img, err := png.Decode(rec.Body)
+		require.NoError(t, err)
+		return img
+	}
+
+	gray := getImage("").(*image.Gray)
+	inverted := getImage("?mode=inverted").(*image.Gray)
+	for idx := range gray.Pix {
+		require.Equal(t, 255-gray.Pix[idx], inverted.Pix[idx])
+	}
+
+	shifted := getImage("?azimuth=135&altitude=30&zfactor=2").(*image.Gray)
+	assert.NotEqual(t, gray.Pix, shifted.Pix)
+
+	assert.IsType(t, &image.NRGBA{}, getImage("?mode=transparent"))
+	assert.IsType(t, &image.NRGBA{}, getImage("?transp=1"))
+
+	multi := getImage("?shading=multidirectional").(*image.Gray)
+	assert.NotEqual(t, gray.Pix, multi.Pix)
+	getImage("?shading=combined&mode=transparent")
+
+	for _, query := range []string{"?azimuth=361", "?altitude=-1", "?zfactor=0", "?zfactor=abc", "?mode=sepia", "?shading=sunset"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/terrain/14/11583/6049.img"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func Test_HillshadeElevation_azimuth(t *testing.T) {
+	const size = 8
+
+	shadeAt := func(data []float64, azimuth float64) uint8 {
+		img, err := HillshadeElevation(data, size, size, 1, 10, 1.0, 45, azimuth, HillshadeShadingStandard)
+		require.NoError(t, err)
+		return img.(*image.Gray).GrayAt(3, 3).Y
+	}
+
+	// plane rising towards north-east, i.e. slope facing south-west
+	southWest := make([]float64, size*size)
+	// plane rising towards north, i.e. slope facing south
+	south := make([]float64, size*size)
+	for idx := range southWest {
+		x, y := idx%size, idx/size
+		southWest[idx] = float64(x-y) * 10
+		south[idx] = float64(size-y) * 10
+	}
+
+	// lit from the facing side is bright, from behind dark,
+	// across the slope in between
+	assert.Greater(t, shadeAt(southWest, 225), shadeAt(southWest, 135))
+	assert.Equal(t, shadeAt(southWest, 135), shadeAt(southWest, 315))
+	assert.Greater(t, shadeAt(southWest, 135), shadeAt(southWest, 45))
+
+	assert.Equal(t, shadeAt(south, 135), shadeAt(south, 225))
+	assert.Greater(t, shadeAt(south, 135), shadeAt(south, 45))
+	assert.Greater(t, shadeAt(south, 180), shadeAt(south, 135))
+}
+
+func Test_HillshadeElevation_shading(t *testing.T) {
+	const size = 8
+
+	// plane rising towards east, i.e. slope facing west, and flat terrain
+	plane := make([]float64, size*size)
+	flat := make([]float64, size*size)
+	for idx := range plane {
+		plane[idx] = float64(idx%size) * 10
+		flat[idx] = 100
+	}
+
+	shadeAt := func(data []float64, shading HillshadeShading, azimuth float64) uint8 {
+		img, err := HillshadeElevation(data, size, size, 1, 10, 1.0, 45, azimuth, shading)
+		require.NoError(t, err)
+		return img.(*image.Gray).GrayAt(3, 3).Y
+	}
+
+	for _, shading := range []HillshadeShading{HillshadeShadingStandard, HillshadeShadingMultidirectional} {
+		assert.Equal(t, uint8(180), shadeAt(flat, shading, 315), shading)
+	}
+	// no slope - no darkening
+	assert.Equal(t, uint8(255), shadeAt(flat, HillshadeShadingCombined, 315))
+
+	// slope lit from opposite side is dark in standard shading
+	// but stays visible in multidirectional one
+	assert.Equal(t, uint8(0), shadeAt(plane, HillshadeShadingStandard, 90))
+	assert.Greater(t, shadeAt(plane, HillshadeShadingMultidirectional, 90), uint8(0))
+	assert.Equal(t, shadeAt(plane, HillshadeShadingMultidirectional, 90), shadeAt(plane, HillshadeShadingMultidirectional, 315))
+
+	// slope lit from the same side is bright
+	assert.Greater(t, shadeAt(plane, HillshadeShadingStandard, 270), uint8(200))
+
+	// combined shading darkens slopes regardless of light direction
+	assert.Less(t, shadeAt(plane, HillshadeShadingCombined, 315), shadeAt(plane, HillshadeShadingStandard, 315))
+	assert.Greater(t, shadeAt(plane, HillshadeShadingCombined, 90), uint8(0))
+
+	// multidirectional shading narrows spread of light and dark slopes
+	// of different aspects
+	planes := map[string]func(x, y int) float64{
+		"west":  func(x, y int) float64 { return float64(x) * 10 },
+		"east":  func(x, y int) float64 { return float64(size-x) * 10 },
+		"north": func(x, y int) float64 { return float64(y) * 10 },
+		"south": func(x, y int) float64 { return float64(size-y) * 10 },
+	}
+	shades := func(shading HillshadeShading) map[string]uint8 {
+		out := make(map[string]uint8)
+		for name, fn := range planes {
+			data := make([]float64, size*size)
+			for idx := range data {
+				data[idx] = fn(idx%size, idx/size)
+			}
+			out[name] = shadeAt(data, shading, 315)
+		}
+		return out
+	}
+	standard := shades(HillshadeShadingStandard)
+	multi := shades(HillshadeShadingMultidirectional)
+	// slopes facing away from the light are brighter, facing it darker
+	assert.Greater(t, multi["east"], standard["east"])
+	assert.Greater(t, multi["south"], standard["south"])
+	assert.Less(t, multi["west"], standard["west"])
+	assert.Less(t, multi["north"], standard["north"])
+	assert.Less(t, int(multi["west"])-int(multi["east"]), int(standard["west"])-int(standard["east"]))
+	assert.Less(t, int(multi["north"])-int(multi["south"]), int(standard["north"])-int(standard["south"]))
+
+	_, err := HillshadeElevation(flat, size, size, 1, 10, 1.0, 45, 315, "unknown")
+	assert.Error(t, err)
+}
+
+func Test_tilesContoursHandler_index(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		require.Equal(t, http.StatusOK, rec.Code, url)
+		return rec
+	}
+
+	for _, tst := range []struct {
+		query string
+		major float64
+	}{
+		{"?interval=10", 50},
+		{"?interval=10&major=4", 40},
+	} {
+		fc, err := geojson.UnmarshalFeatureCollection(get("/contours/14/11583/6049.geojson" + tst.query).Body.Bytes())
+		require.NoError(t, err)
+
+		numIndex := 0
+		for _, feat := range fc.Features {
+			elevation := feat.Properties.MustFloat64("elevation")
+			index := feat.Properties.MustBool("index")
+			assert.Equal(t, math.Mod(elevation, tst.major) == 0, index, "%s elevation %v", tst.query, elevation)
+			if index {
+				numIndex++
+			}
+		}
+		assert.NotZero(t, numIndex, tst.query)
+		assert.Less(t, numIndex, len(fc.Features), tst.query)
+	}
+
+	layers, err := mvt.Unmarshal(get("/contours/14/11583/6049.mvt?interval=10").Body.Bytes())
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+
+	layers, err = mvt.Unmarshal(get("/contours/14/11583/6049.mvt?interval=10&split=1").Body.Bytes())
+	require.NoError(t, err)
+	require.Len(t, layers, 2)
+	for _, layer := range layers {
+		require.NotEmpty(t, layer.Features, layer.Name)
+		for _, feat := range layer.Features {
+			assert.Equal(t, layer.Name == "contours_index", feat.Properties.MustBool("index"), layer.Name)
+		}
+	}
+
+	for _, query := range []string{"?major=0", "?major=x"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/contours/14/11583/6049.geojson"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func Test_contourInterval_1(t *testing.T) {
+	table, err := parseContourIntervals(map[string]string{"14": "20", "10": "200", "12": "50.5"})
+	require.NoError(t, err)
+	assert.Equal(t, []zoomInterval{{10, 200}, {12, 50.5}, {14, 20}}, table)
+
+	for zoom, interval := range map[int]float64{5: 200, 10: 200, 11: 200, 12: 50.5, 13: 50.5, 14: 20, 18: 20} {
+		assert.Equal(t, interval, contourInterval(table, zoom), "zoom %d", zoom)
+	}
+
+	for _, m := range []map[string]string{{}, {"x": "10"}, {"-1": "10"}, {"10": "0"}, {"10": "abc"}} {
+		_, err := parseContourIntervals(m)
+		assert.Error(t, err, m)
+	}
+}
+
+func Test_tilesContoursHandler_units(t *testing.T) {
+	h := newTestTerra(t)
+	r := newRouter(h)
+
+	getLevels := func(query string) map[float64]bool {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/contours/14/11583/6049.geojson"+query, nil))
+		require.Equal(t, http.StatusOK, rec.Code, query)
+		fc, err := geojson.UnmarshalFeatureCollection(rec.Body.Bytes())
+		require.NoError(t, err)
+		levels := make(map[float64]bool)
+		for _, feat := range fc.Features {
+			levels[feat.Properties.MustFloat64("elevation")] = true
+		}
+		require.NotEmpty(t, levels, query)
+		return levels
+	}
+
+	// default interval of zoom level
+	for level := range getLevels("") {
+		assert.Zero(t, math.Mod(level, contourInterval(defaultContourIntervals[UnitsMeters], 14)), level)
+	}
+
+	for level := range getLevels("?interval=12.5") {
+		assert.Zero(t, math.Mod(level, 12.5), level)
+	}
+
+	// levels in feet span range of levels in meters converted to feet
+	levelsM := getLevels("?interval=10")
+	levelsFt := getLevels("?interval=10&units=ft")
+	minM, maxM := math.Inf(1), math.Inf(-1)
+	for level := range levelsM {
+		minM, maxM = math.Min(minM, level), math.Max(maxM, level)
+	}
+	for level := range levelsFt {
+		assert.Zero(t, math.Mod(level, 10), level)
+		assert.InDelta(t, (minM+maxM)/2/metersPerFoot, level, (maxM-minM+20)/2/metersPerFoot, level)
+	}
+	assert.Greater(t, len(levelsFt), len(levelsM))
+
+	for _, query := range []string{"?interval=0", "?interval=-5", "?interval=abc", "?interval=NaN", "?units=yd", "?interval=0.0001"} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/contours/14/11583/6049.geojson"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/isobands/14/11583/6049.geojson?interval=0.0001", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func Test_serveUntilDone_flushesDiskCache(t *testing.T) {
+	rootDir := t.TempDir()
+
+	h := newTestTerra(t)
+	var err error
+	h.diskCacheTileStore, err = NewDiskCacheTileStore(rootDir, 100, EvictionLRU)
+	require.NoError(t, err)
+	h.diskCacheTileStore.Add(1, 0, 0, []byte("aaaa"))
+	indexFile := filepath.Join(rootDir, diskCacheIndexFile)
+	require.NoError(t, os.RemoveAll(indexFile))
+
+	srv := &http.Server{Addr: "127.0.0.1:0", Handler: newRouter(h)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serveUntilDone(ctx, srv, srv.ListenAndServe, h)
+	}()
+
+	cancel()
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not shut down")
+	}
+	// index is flushed on shutdown
+	assert.FileExists(t, indexFile)
+
+	// failed listen is returned
+	srv = &http.Server{Addr: "127.0.0.1:-1"}
+	err = serveUntilDone(context.Background(), srv, srv.ListenAndServe, h)
+	assert.Error(t, err)
+}